@@ -0,0 +1,195 @@
+package bot
+
+import (
+	"errors"
+	"gameserver/core/network"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+var ErrBotClosed = errors.New("bot is closed")
+var ErrWaitTimeout = errors.New("wait timeout")
+
+// one simulated player, implements network.Agent
+type Bot struct {
+	sync.Mutex
+	Id        uint64
+	conn      *network.TCPConn
+	runner    *Runner
+	waits     map[uint32][]chan proto.Message
+	closeFlag bool
+	closeChan chan struct{}
+
+	// free for the script to keep its state
+	Data map[string]interface{}
+}
+
+func newBot(conn *network.TCPConn, runner *Runner) *Bot {
+	return &Bot{
+		Id:        conn.ID(),
+		conn:      conn,
+		runner:    runner,
+		waits:     make(map[uint32][]chan proto.Message),
+		closeChan: make(chan struct{}),
+		Data:      make(map[string]interface{}),
+	}
+}
+
+func (this *Bot) Run() {
+	this.runner.addBot(this)
+	go this.runner.runScript(this)
+
+	for {
+		msgData, err := this.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		this.runner.Processor.Route(this.Id, msgData)
+	}
+}
+
+func (this *Bot) OnClose() {
+	this.Lock()
+	this.closeFlag = true
+	close(this.closeChan)
+	this.waits = make(map[uint32][]chan proto.Message)
+	this.Unlock()
+
+	this.runner.removeBot(this)
+}
+
+// stop the bot, the script ends at its next Send or Wait
+func (this *Bot) Close() {
+	this.conn.Close()
+}
+
+// closed when the connection is gone
+func (this *Bot) Done() <-chan struct{} {
+	return this.closeChan
+}
+
+func (this *Bot) Send(msgId uint32, msg proto.Message) error {
+	if this.isClosed() {
+		return ErrBotClosed
+	}
+
+	msgData, err := this.runner.Processor.Marshal(msgId, msg)
+	if err != nil {
+		this.runner.Stats.AddError(msgId)
+		return err
+	}
+	if err := this.conn.WriteMsg(msgData); err != nil {
+		this.runner.Stats.AddError(msgId)
+		return err
+	}
+
+	return nil
+}
+
+func (this *Bot) isClosed() bool {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.closeFlag
+}
+
+func (this *Bot) addWait(msgId uint32) chan proto.Message {
+	c := make(chan proto.Message, 1)
+
+	this.Lock()
+	defer this.Unlock()
+	if !this.closeFlag {
+		this.waits[msgId] = append(this.waits[msgId], c)
+	}
+
+	return c
+}
+
+func (this *Bot) removeWait(msgId uint32, c chan proto.Message) {
+	this.Lock()
+	defer this.Unlock()
+
+	waits := this.waits[msgId]
+	for i := 0; i < len(waits); i++ {
+		if waits[i] == c {
+			this.waits[msgId] = append(waits[:i], waits[i+1:]...)
+			return
+		}
+	}
+}
+
+// deliver msg to the oldest waiter, return false if nobody waits for it
+func (this *Bot) deliver(msgId uint32, msg proto.Message) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	waits := this.waits[msgId]
+	if len(waits) == 0 {
+		return false
+	}
+	waits[0] <- msg
+	this.waits[msgId] = waits[1:]
+
+	return true
+}
+
+func (this *Bot) wait(msgId uint32, c chan proto.Message, timeout time.Duration) (proto.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-c:
+		return msg, nil
+	case <-timer.C:
+		this.removeWait(msgId, c)
+		return nil, ErrWaitTimeout
+	case <-this.closeChan:
+		return nil, ErrBotClosed
+	}
+}
+
+// block until the server sends msgId
+func (this *Bot) Wait(msgId uint32, timeout time.Duration) (proto.Message, error) {
+	if this.isClosed() {
+		return nil, ErrBotClosed
+	}
+
+	return this.wait(msgId, this.addWait(msgId), timeout)
+}
+
+// send msg and wait for respId, the round trip is recorded under msgId
+func (this *Bot) Request(msgId uint32, msg proto.Message, respId uint32, timeout time.Duration) (proto.Message, error) {
+	if this.isClosed() {
+		return nil, ErrBotClosed
+	}
+
+	c := this.addWait(respId)
+	start := time.Now()
+	if err := this.Send(msgId, msg); err != nil {
+		this.removeWait(respId, c)
+		return nil, err
+	}
+
+	resp, err := this.wait(respId, c, timeout)
+	if err != nil {
+		this.runner.Stats.AddError(msgId)
+		return nil, err
+	}
+	this.runner.Stats.AddLatency(msgId, time.Since(start))
+
+	return resp, nil
+}
+
+// sleep unless the bot closes first
+func (this *Bot) Sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-this.closeChan:
+		return ErrBotClosed
+	}
+}
@@ -0,0 +1,263 @@
+package bot
+
+import (
+	"gameserver/core/log"
+	"gameserver/core/network"
+	"gameserver/core/processor"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// one scripted behaviour, such as login, move, chat or battle
+type Step struct {
+	Name     string
+	Do       func(bot *Bot) error
+	Repeat   int // <= 0 means once
+	Interval time.Duration
+}
+
+// ramp linearly from the bots of the previous stage to Bots over Duration,
+// up or down, a stage with the same Bots holds the load
+type Stage struct {
+	Bots     int
+	Duration time.Duration
+}
+
+type Runner struct {
+	sync.Mutex
+	Addrs     []string
+	Processor processor.Processor
+	Script    []Step
+	Loop      bool
+	Stages    []Stage
+	RampStep  time.Duration
+	Stats     *Stats
+
+	// a bot redials MaxRetry times before it gives up, 0 means forever, see
+	// TCPClient
+	ConnectInterval    time.Duration
+	MaxConnectInterval time.Duration
+	MaxRetry           int
+	DialTimeout        time.Duration
+
+	// msg parser, must match the server
+	LenMsgLen    int
+	MinMsgLen    uint32
+	MaxMsgLen    uint32
+	LittleEndian bool
+
+	clients       []*network.TCPClient
+	bots          map[uint64]*Bot
+	stepErrors    map[string]int64
+	connectErrors int64
+}
+
+// msgs the script waits for
+func (this *Runner) Register(msgId uint32, msg proto.Message) {
+	this.RegisterPush(msgId, msg, nil)
+}
+
+// msgs pushed by the server, handler is called when no Wait or Request is
+// pending on msgId
+func (this *Runner) RegisterPush(msgId uint32, msg proto.Message, handler func(bot *Bot, msg proto.Message)) {
+	this.Processor.Register(msgId, msg, func(clientId uint64, msg proto.Message) {
+		bot := this.getBot(clientId)
+		if bot == nil {
+			return
+		}
+		if !bot.deliver(msgId, msg) && handler != nil {
+			handler(bot, msg)
+		}
+	})
+}
+
+func (this *Runner) init() {
+	if this.Processor == nil {
+		log.Fatal("Processor must not be nil")
+	}
+	if len(this.Addrs) == 0 {
+		log.Fatal("Addrs must not be empty")
+	}
+	if len(this.Stages) == 0 {
+		log.Fatal("Stages must not be empty")
+	}
+	if this.RampStep <= 0 {
+		this.RampStep = time.Second
+		log.Info("invalid RampStep, reset to %v", this.RampStep)
+	}
+	if this.ConnectInterval <= 0 {
+		this.ConnectInterval = time.Second
+		log.Info("invalid ConnectInterval, reset to %v", this.ConnectInterval)
+	}
+	if this.Stats == nil {
+		this.Stats = NewStats()
+	}
+
+	this.Lock()
+	this.bots = make(map[uint64]*Bot)
+	this.stepErrors = make(map[string]int64)
+	this.connectErrors = 0
+	this.Unlock()
+}
+
+func (this *Runner) addBot(bot *Bot) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.bots[bot.Id] = bot
+}
+
+func (this *Runner) removeBot(bot *Bot) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.bots, bot.Id)
+}
+
+func (this *Runner) getBot(id uint64) *Bot {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.bots[id]
+}
+
+// bots that gave up connecting
+func (this *Runner) ConnectErrors() int64 {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.connectErrors
+}
+
+func (this *Runner) BotNum() int {
+	this.Lock()
+	defer this.Unlock()
+
+	return len(this.bots)
+}
+
+func (this *Runner) runScript(bot *Bot) {
+	for {
+		for _, step := range this.Script {
+			for i := 0; i < step.Repeat || i == 0; i++ {
+				err := step.Do(bot)
+				if err == ErrBotClosed {
+					return
+				} else if err != nil {
+					this.Lock()
+					this.stepErrors[step.Name]++
+					this.Unlock()
+				}
+
+				if step.Interval > 0 && bot.Sleep(step.Interval) != nil {
+					return
+				}
+			}
+		}
+
+		if !this.Loop {
+			return
+		}
+	}
+}
+
+func (this *Runner) startBots(n int) {
+	client := &network.TCPClient{
+		Addrs:              this.Addrs,
+		ConnNum:            n,
+		ConnectInterval:    this.ConnectInterval,
+		MaxConnectInterval: this.MaxConnectInterval,
+		MaxRetry:           this.MaxRetry,
+		DialTimeout:        this.DialTimeout,
+		LenMsgLen:          this.LenMsgLen,
+		MinMsgLen:          this.MinMsgLen,
+		MaxMsgLen:          this.MaxMsgLen,
+		LittleEndian:       this.LittleEndian,
+		NewAgent: func(conn *network.TCPConn) network.Agent {
+			return newBot(conn, this)
+		},
+		OnStateChange: func(addr string, state int) {
+			if state == network.ClientGaveUp {
+				this.Lock()
+				this.connectErrors++
+				this.Unlock()
+			}
+		},
+	}
+	client.Start()
+
+	this.clients = append(this.clients, client)
+}
+
+// close n online bots, fewer if fewer are online
+func (this *Runner) stopBots(n int) {
+	this.Lock()
+	bots := make([]*Bot, 0, n)
+	for _, bot := range this.bots {
+		if len(bots) == n {
+			break
+		}
+		bots = append(bots, bot)
+	}
+	this.Unlock()
+
+	for _, bot := range bots {
+		bot.Close()
+	}
+}
+
+// the bots to be running after elapsed of stage, ramping from from
+func rampTarget(from int, stage Stage, elapsed time.Duration) int {
+	if stage.Duration <= 0 || elapsed >= stage.Duration {
+		return stage.Bots
+	}
+	return from + int(int64(stage.Bots-from)*int64(elapsed)/int64(stage.Duration))
+}
+
+// block until every stage is done, then disconnect the bots and report
+func (this *Runner) Run() []*MsgReport {
+	this.init()
+
+	running := 0
+	for _, stage := range this.Stages {
+		from := running
+		begin := time.Now()
+		for {
+			elapsed := time.Since(begin)
+			if elapsed > stage.Duration {
+				elapsed = stage.Duration
+			}
+
+			target := rampTarget(from, stage, elapsed)
+			if target > running {
+				this.startBots(target - running)
+			} else if target < running {
+				this.stopBots(running - target)
+			}
+			running = target
+
+			if elapsed >= stage.Duration {
+				break
+			}
+			time.Sleep(this.RampStep)
+		}
+		log.Info("bot stage done, running: %v, online: %v", running, this.BotNum())
+	}
+
+	for _, client := range this.clients {
+		client.Close(true)
+	}
+	this.clients = nil
+
+	reports := this.Stats.Report()
+	log.Info("bot report:\n%s", FormatReport(reports))
+	this.Lock()
+	for name, n := range this.stepErrors {
+		log.Info("bot step %v errors: %v", name, n)
+	}
+	log.Info("bot connect errors: %v", this.connectErrors)
+	this.Unlock()
+
+	return reports
+}
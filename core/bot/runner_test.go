@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"gameserver/core/processor"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRampTarget(t *testing.T) {
+	tests := []struct {
+		from    int
+		stage   Stage
+		elapsed time.Duration
+		want    int
+	}{
+		{0, Stage{Bots: 100, Duration: 10 * time.Second}, 0, 0},
+		{0, Stage{Bots: 100, Duration: 10 * time.Second}, 5 * time.Second, 50},
+		{0, Stage{Bots: 100, Duration: 10 * time.Second}, 20 * time.Second, 100},
+		{50, Stage{Bots: 150, Duration: 10 * time.Second}, time.Second, 60},
+		{100, Stage{Bots: 100, Duration: 10 * time.Second}, time.Second, 100},
+		{0, Stage{Bots: 10}, 0, 10},
+		{100, Stage{Bots: 50, Duration: 10 * time.Second}, 5 * time.Second, 75},
+	}
+	for _, test := range tests {
+		if got := rampTarget(test.from, test.stage, test.elapsed); got != test.want {
+			t.Errorf("ramp from %v to %+v after %v: %v, want %v", test.from, test.stage, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestRunnerConnectErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	runner := &Runner{
+		Addrs:           []string{addr},
+		Processor:       processor.NewPBProcessor(),
+		Stages:          []Stage{{Bots: 2}, {Bots: 2, Duration: 200 * time.Millisecond}},
+		RampStep:        10 * time.Millisecond,
+		ConnectInterval: 5 * time.Millisecond,
+		MaxRetry:        1,
+	}
+	runner.Run()
+
+	if n := runner.ConnectErrors(); n != 2 {
+		t.Fatalf("connect errors %v, want 2", n)
+	}
+}
+
+func TestRunnerRampDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	runner := &Runner{
+		Addrs:           []string{ln.Addr().String()},
+		Processor:       processor.NewPBProcessor(),
+		Stages:          []Stage{{Bots: 3}, {Bots: 3, Duration: 300 * time.Millisecond}, {Bots: 1}, {Bots: 1, Duration: 300 * time.Millisecond}},
+		RampStep:        10 * time.Millisecond,
+		ConnectInterval: 5 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		runner.Run()
+		close(done)
+	}()
+
+	var seen []int
+	for {
+		select {
+		case <-done:
+			if len(seen) != 2 || seen[0] != 3 || seen[1] != 1 {
+				t.Fatalf("bots online %v, want [3 1]", seen)
+			}
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+		if n := runner.BotNum(); n == 3 && len(seen) == 0 || n == 1 && len(seen) == 1 {
+			seen = append(seen, n)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latency samples kept per msgId, older samples are replaced at random once
+// the reservoir is full
+const maxSamples = 10000
+
+type msgStats struct {
+	count   int64
+	errors  int64
+	samples []time.Duration
+	max     time.Duration
+}
+
+type MsgReport struct {
+	MsgId     uint32
+	Count     int64
+	Errors    int64
+	ErrorRate float64
+	P50       time.Duration
+	P90       time.Duration
+	P99       time.Duration
+	Max       time.Duration
+}
+
+// goroutine safe
+type Stats struct {
+	sync.Mutex
+	msgs map[uint32]*msgStats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		msgs: make(map[uint32]*msgStats),
+	}
+}
+
+func (this *Stats) get(msgId uint32) *msgStats {
+	stats, ok := this.msgs[msgId]
+	if !ok {
+		stats = &msgStats{}
+		this.msgs[msgId] = stats
+	}
+	return stats
+}
+
+func (this *Stats) AddLatency(msgId uint32, d time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	stats := this.get(msgId)
+	stats.count++
+	if d > stats.max {
+		stats.max = d
+	}
+	if len(stats.samples) < maxSamples {
+		stats.samples = append(stats.samples, d)
+	} else if i := rand.Int63n(stats.count); i < maxSamples {
+		stats.samples[i] = d
+	}
+}
+
+func (this *Stats) AddError(msgId uint32) {
+	this.Lock()
+	defer this.Unlock()
+
+	stats := this.get(msgId)
+	stats.count++
+	stats.errors++
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// sorted by msgId
+func (this *Stats) Report() []*MsgReport {
+	this.Lock()
+	defer this.Unlock()
+
+	reports := make([]*MsgReport, 0, len(this.msgs))
+	for msgId, stats := range this.msgs {
+		sorted := make([]time.Duration, len(stats.samples))
+		copy(sorted, stats.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		report := &MsgReport{
+			MsgId:  msgId,
+			Count:  stats.count,
+			Errors: stats.errors,
+			P50:    percentile(sorted, 0.5),
+			P90:    percentile(sorted, 0.9),
+			P99:    percentile(sorted, 0.99),
+			Max:    stats.max,
+		}
+		if stats.count > 0 {
+			report.ErrorRate = float64(stats.errors) / float64(stats.count)
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].MsgId < reports[j].MsgId })
+
+	return reports
+}
+
+func FormatReport(reports []*MsgReport) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-10s %10s %8s %8s %12s %12s %12s %12s\n",
+		"msgId", "count", "errors", "errRate", "p50", "p90", "p99", "max")
+	for _, r := range reports {
+		fmt.Fprintf(&buf, "%-10d %10d %8d %7.2f%% %12v %12v %12v %12v\n",
+			r.MsgId, r.Count, r.Errors, r.ErrorRate*100, r.P50, r.P90, r.P99, r.Max)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"gameserver/core/log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.InitLog(os.TempDir(), "error", false, 0)
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+
+	tests := []struct {
+		samples []time.Duration
+		p       float64
+		want    time.Duration
+	}{
+		{nil, 0.5, 0},
+		{sorted[:1], 0.99, 1},
+		{sorted, 0, 1},
+		{sorted, 0.5, 50},
+		{sorted, 0.9, 90},
+		{sorted, 0.99, 99},
+		{sorted, 1, 100},
+	}
+	for _, test := range tests {
+		if got := percentile(test.samples, test.p); got != test.want {
+			t.Errorf("percentile of %v samples at %v: %v, want %v", len(test.samples), test.p, got, test.want)
+		}
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	stats := NewStats()
+	for i := 100; i >= 1; i-- {
+		stats.AddLatency(2, time.Duration(i)*time.Millisecond)
+	}
+	stats.AddLatency(1, time.Millisecond)
+	stats.AddError(1)
+
+	reports := stats.Report()
+	if len(reports) != 2 || reports[0].MsgId != 1 || reports[1].MsgId != 2 {
+		t.Fatalf("reports %+v", reports)
+	}
+	if r := reports[0]; r.Count != 2 || r.Errors != 1 || r.ErrorRate != 0.5 {
+		t.Fatalf("report %+v", r)
+	}
+	if r := reports[1]; r.P50 != 50*time.Millisecond || r.P99 != 99*time.Millisecond || r.Max != 100*time.Millisecond {
+		t.Fatalf("report %+v", r)
+	}
+
+	lines := strings.Split(strings.TrimSpace(FormatReport(reports)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "msgId") || !strings.Contains(lines[1], "50.00%") {
+		t.Fatalf("report:\n%s", strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	"gameserver/core/network"
+	"gameserver/core/processor"
+	"gameserver/core/processor/pb"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+// one connection of a Client, implements network.Agent
+type agent struct {
+	client *Client
+	conn   *network.TCPConn
+}
+
+func (this *agent) Run() {
+	this.client.Lock()
+	this.client.conn = this.conn
+	this.client.Unlock()
+
+	go this.client.start(this.conn)
+
+	for {
+		msgData, err := this.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		this.client.route(msgData)
+	}
+}
+
+func (this *agent) OnClose() {
+	client := this.client
+
+	client.Lock()
+	if client.conn == this.conn {
+		client.conn = nil
+	}
+	pending := client.pending
+	client.pending = make(map[uint32]chan []byte)
+	handshake := client.handshake
+	client.handshake = nil
+	client.Unlock()
+
+	for _, c := range pending {
+		close(c)
+	}
+	if handshake != nil {
+		close(handshake)
+	}
+
+	if client.OnDisconnect != nil {
+		client.OnDisconnect()
+	}
+}
+
+// handshake and Login on a new connection, the first Connect waits for it
+func (this *Client) start(conn *network.TCPConn) {
+	err := this.doHandshake()
+	if err == nil && this.Login != nil {
+		err = this.Login(this)
+	}
+
+	if err != nil {
+		log.Warn("connect to %v error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	} else if this.OnConnect != nil {
+		this.OnConnect()
+	}
+
+	this.Lock()
+	ready := this.ready
+	this.Unlock()
+	select {
+	case ready <- err:
+	default:
+	}
+}
+
+func (this *Client) doHandshake() error {
+	if this.Version == 0 {
+		return nil
+	}
+
+	c := make(chan *pb.HandshakeResp, 1)
+	this.Lock()
+	this.handshake = c
+	this.Unlock()
+
+	err := this.Send(processor.HANDSHAKE_REQ_MSG_ID, &pb.HandshakeReq{
+		Version:      this.Version,
+		Capabilities: this.Capabilities,
+	})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(this.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp, ok := <-c:
+		if !ok {
+			return ErrDisconnected
+		}
+		if resp.Code != 0 {
+			return processor.NewCodeError(resp.Code, resp.Message)
+		}
+
+		this.Lock()
+		this.version = resp.Version
+		this.capabilities = resp.Capabilities
+		this.Unlock()
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// responses go to their Request, the rest to the processor
+func (this *Client) route(msgData []byte) {
+	if len(msgData) < utils2.MSG_ID_LEN {
+		log.Warn("msg too short")
+		return
+	}
+	msgId := utils.ByteToUint32(msgData, this.littleEndian)
+
+	switch {
+	case msgId == processor.HANDSHAKE_RESP_MSG_ID:
+		this.routeHandshake(msgData[utils2.MSG_ID_LEN:])
+	case this.processor.IsResponse(msgId):
+		this.routeResponse(msgData)
+	default:
+		this.processor.Route(LOCAL_CLIENT_ID, msgData)
+	}
+}
+
+func (this *Client) routeHandshake(msgData []byte) {
+	resp := &pb.HandshakeResp{}
+	if err := proto.Unmarshal(msgData, resp); err != nil {
+		log.Warn("invalid handshake: %v", err)
+		return
+	}
+
+	this.Lock()
+	c := this.handshake
+	this.handshake = nil
+	this.Unlock()
+
+	if c != nil {
+		c <- resp
+	}
+}
+
+func (this *Client) routeResponse(msgData []byte) {
+	if len(msgData) < utils2.REQUEST_HEAD_LEN {
+		log.Warn("response too short")
+		return
+	}
+	seq := utils.ByteToUint32(msgData[utils2.MSG_ID_LEN:], this.littleEndian)
+
+	c := this.removePending(seq)
+	if c == nil {
+		log.Debug("response of seq %v after its timeout", seq)
+		return
+	}
+	c <- msgData
+}
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"errors"
+	"gameserver/core/log"
+	"gameserver/core/network"
+	"gameserver/core/processor"
+	"gameserver/core/processor/pb"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+var ErrNotConnected = errors.New("client is not connected")
+var ErrDisconnected = errors.New("disconnected")
+var ErrTimeout = errors.New("timeout")
+var ErrSeqPending = errors.New("a request with the seq is pending")
+
+// the clientId pushes are routed with, the same for every connection so a
+// reliable push sent again after a reconnect is not handled twice
+const LOCAL_CLIENT_ID = 0
+
+// a connection to a server speaking the frames of PBProcessor, for bots,
+// tools and integration tests. register the pushes and responses, then
+// Connect
+type Client struct {
+	sync.Mutex
+	Addrs           []string
+	ConnectInterval time.Duration
+	// bounds Connect and each dial
+	ConnectTimeout time.Duration
+	RequestTimeout time.Duration
+	AutoReconnect  bool
+
+	// HandshakeReq is sent after each connect unless Version is 0
+	Version      uint32
+	Capabilities uint64
+
+	// called after the handshake of each connect, it may send requests. an
+	// error closes the connection and fails the first Connect
+	Login func(client *Client) error
+
+	// called from the connection goroutines, OnConnect after Login
+	OnConnect    func()
+	OnDisconnect func()
+
+	// called from the connection goroutine with the ErrorResp the server
+	// replies to a msg that is not a request, a bad frame for example
+	OnError func(msgId uint32, err *processor.CodeError)
+
+	// msg parser, must match the server
+	LenMsgLen    int
+	MinMsgLen    uint32
+	MaxMsgLen    uint32
+	LittleEndian bool
+
+	processor    *processor.PBProcessor
+	littleEndian bool
+	tcpClient    *network.TCPClient
+	conn         *network.TCPConn
+	ready        chan error
+
+	// requests waiting for their response by seq
+	seq     uint32
+	pending map[uint32]chan []byte
+
+	// set by the handshake
+	handshake    chan *pb.HandshakeResp
+	version      uint32
+	capabilities uint64
+}
+
+func NewClient(addrs ...string) *Client {
+	client := &Client{
+		Addrs:           addrs,
+		ConnectInterval: time.Second,
+		ConnectTimeout:  10 * time.Second,
+		RequestTimeout:  5 * time.Second,
+		AutoReconnect:   true,
+		processor:       processor.NewPBProcessor(),
+		littleEndian:    true,
+		pending:         make(map[uint32]chan []byte),
+	}
+	client.processor.SetSender(func(clientId uint64, msgData []byte) error {
+		return client.write(msgData)
+	})
+	client.processor.Register(processor.ERROR_MSG_ID, &pb.ErrorResp{}, client.onError)
+
+	return client
+}
+
+// the processor the frames are made and routed by, for tracing and metrics
+func (this *Client) Processor() *processor.PBProcessor {
+	return this.processor
+}
+
+// byte order of the frame heads, must match the processor of the server
+func (this *Client) SetByteOrder(littleEndian bool) {
+	this.littleEndian = littleEndian
+	this.processor.SetByteOrder(littleEndian)
+}
+
+// msgs pushed by the server, handler is called from the connection goroutine
+// so it must not call Request, which waits for that goroutine to read the
+// response, call it from another goroutine instead
+func (this *Client) RegisterPush(msgId uint32, msg proto.Message, handler func(msg proto.Message)) {
+	this.processor.Register(msgId, msg, func(clientId uint64, msg proto.Message) {
+		handler(msg)
+	})
+}
+
+// the response respId of the requests sent by Request
+func (this *Client) RegisterResponse(respId uint32, resp proto.Message) {
+	this.processor.RegisterResponse(respId, resp)
+}
+
+// connect, handshake and Login, reconnects later on are done in the
+// background if AutoReconnect is set
+func (this *Client) Connect() error {
+	this.Lock()
+	if this.tcpClient != nil {
+		this.Unlock()
+		return errors.New("client is running")
+	}
+	if len(this.Addrs) == 0 {
+		this.Unlock()
+		return errors.New("no server addrs")
+	}
+	this.ready = make(chan error, 1)
+	this.tcpClient = &network.TCPClient{
+		Addrs:           this.Addrs,
+		ConnectInterval: this.ConnectInterval,
+		DialTimeout:     this.ConnectTimeout,
+		AutoReconnect:   this.AutoReconnect,
+		NewAgent: func(conn *network.TCPConn) network.Agent {
+			return &agent{client: this, conn: conn}
+		},
+		LenMsgLen:    this.LenMsgLen,
+		MinMsgLen:    this.MinMsgLen,
+		MaxMsgLen:    this.MaxMsgLen,
+		LittleEndian: this.LittleEndian,
+	}
+	tcpClient, ready := this.tcpClient, this.ready
+	this.Unlock()
+
+	tcpClient.Start()
+
+	timer := time.NewTimer(this.ConnectTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			this.Close()
+		}
+		return err
+	case <-timer.C:
+		this.Close()
+		return ErrTimeout
+	}
+}
+
+// stop reconnecting and close the connection, the requests waiting fail
+// with ErrDisconnected
+func (this *Client) Close() {
+	this.Lock()
+	tcpClient := this.tcpClient
+	this.tcpClient = nil
+	this.Unlock()
+
+	if tcpClient != nil {
+		tcpClient.Close(false)
+	}
+}
+
+func (this *Client) IsConnected() bool {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.conn != nil
+}
+
+// negotiated by the last handshake
+func (this *Client) ServerVersion() (uint32, uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.version, this.capabilities
+}
+
+func (this *Client) write(msgData []byte) error {
+	this.Lock()
+	conn := this.conn
+	this.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.WriteMsg(msgData)
+}
+
+func (this *Client) Send(msgId uint32, msg proto.Message) error {
+	return this.processor.Send(LOCAL_CLIENT_ID, msgId, msg)
+}
+
+// send msg to a handler registered by RegisterRequest and wait for its
+// response, err is a *processor.CodeError if the server replied an error.
+// timeout <= 0 means RequestTimeout
+func (this *Client) Request(msgId uint32, msg proto.Message, timeout time.Duration) (proto.Message, error) {
+	return this.RequestSeq(msgId, this.NextSeq(), msg, timeout)
+}
+
+// the seq of a request to send by RequestSeq
+func (this *Client) NextSeq() uint32 {
+	this.Lock()
+	defer this.Unlock()
+
+	this.seq++
+	return this.seq
+}
+
+// Request with seq from NextSeq, a request that failed or timed out can be
+// sent again with the same seq and msg, so a server with EnableIdempotency
+// replies the outcome of the first try instead of running it twice
+func (this *Client) RequestSeq(msgId uint32, seq uint32, msg proto.Message, timeout time.Duration) (proto.Message, error) {
+	if timeout <= 0 {
+		timeout = this.RequestTimeout
+	}
+
+	this.Lock()
+	if this.conn == nil {
+		this.Unlock()
+		return nil, ErrNotConnected
+	}
+	if _, ok := this.pending[seq]; ok {
+		this.Unlock()
+		return nil, ErrSeqPending
+	}
+	c := make(chan []byte, 1)
+	this.pending[seq] = c
+	this.Unlock()
+
+	if err := this.processor.SendRequest(LOCAL_CLIENT_ID, msgId, seq, msg); err != nil {
+		this.removePending(seq)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-c:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		_, _, resp, err := this.processor.UnmarshalResponse(frame)
+		return resp, err
+	case <-timer.C:
+		this.removePending(seq)
+		return nil, ErrTimeout
+	}
+}
+
+func (this *Client) onError(clientId uint64, msg proto.Message) {
+	errResp := msg.(*pb.ErrorResp)
+	codeErr := processor.NewCodeError(errResp.Code, errResp.Message)
+	if this.OnError == nil {
+		log.Warn("error of msgId: %v, %v", errResp.ReqMsgId, codeErr)
+		return
+	}
+	this.OnError(errResp.ReqMsgId, codeErr)
+}
+
+func (this *Client) removePending(seq uint32) chan []byte {
+	this.Lock()
+	defer this.Unlock()
+
+	c, ok := this.pending[seq]
+	if !ok {
+		return nil
+	}
+	delete(this.pending, seq)
+	return c
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"gameserver/core/log"
+	"gameserver/core/network"
+	"gameserver/core/processor"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.InitLog(os.TempDir(), "error", false, 0)
+}
+
+type testServer struct {
+	sync.Mutex
+	*network.TCPServer
+	processor *processor.PBProcessor
+	conns     map[uint64]*network.TCPConn
+}
+
+type testAgent struct {
+	server *testServer
+	conn   *network.TCPConn
+}
+
+func (this *testAgent) Run() {
+	this.server.Lock()
+	this.server.conns[this.conn.ID()] = this.conn
+	this.server.Unlock()
+
+	for {
+		msgData, err := this.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		this.server.processor.Route(this.conn.ID(), msgData)
+	}
+}
+
+func (this *testAgent) OnClose() {
+	this.server.Lock()
+	delete(this.server.conns, this.conn.ID())
+	this.server.Unlock()
+	this.server.processor.RemoveClient(this.conn.ID())
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := &testServer{
+		processor: processor.NewPBProcessor(),
+		conns:     make(map[uint64]*network.TCPConn),
+	}
+	server.TCPServer = &network.TCPServer{
+		Addr: addr,
+		NewAgent: func(conn *network.TCPConn) network.Agent {
+			return &testAgent{server: server, conn: conn}
+		},
+	}
+	server.processor.SetSender(func(clientId uint64, msgData []byte) error {
+		server.Lock()
+		conn, ok := server.conns[clientId]
+		server.Unlock()
+		if !ok {
+			return errors.New("conn not found")
+		}
+		return conn.WriteMsg(msgData)
+	})
+
+	return server
+}
+
+// close the conns from the server side
+func (this *testServer) kick() {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, conn := range this.conns {
+		conn.Destroy()
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := newTestServer(t)
+	server.processor.EnableHandshake(&processor.HandshakeConfig{MinVersion: 1, MaxVersion: 2, Required: true})
+	server.processor.EnableReliablePush(processor.NewMemoryPushStore(0))
+	server.processor.SetBadFramePolicy(&processor.BadFrameConfig{UnknownMsg: &processor.BadFramePolicy{Reply: true}})
+	server.processor.RegisterRequest(1, &descriptorpb.FileOptions{}, 2, &descriptorpb.FileOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			if err := server.processor.LoginPlayer(clientId, 100); err != nil {
+				return nil, err
+			}
+			return &descriptorpb.FileOptions{JavaPackage: proto.String("welcome")}, nil
+		})
+	server.processor.RegisterRequest(3, &descriptorpb.FileOptions{}, 2, &descriptorpb.FileOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			return nil, processor.NewCodeError(100, "denied")
+		})
+	server.processor.RegisterRequest(5, &descriptorpb.FileOptions{}, 2, &descriptorpb.FileOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			return nil, nil
+		})
+	var buys int32
+	server.processor.RegisterRequest(7, &descriptorpb.FileOptions{}, 2, &descriptorpb.FileOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			return &descriptorpb.FileOptions{JavaPackage: proto.String(fmt.Sprint(atomic.AddInt32(&buys, 1)))}, nil
+		})
+	server.processor.EnableIdempotency(time.Minute, 7)
+	server.Start()
+	defer server.Close()
+
+	// kept until the player logs in
+	server.processor.SendReliable(100, 4, &descriptorpb.FileOptions{JavaPackage: proto.String("offline")})
+
+	logins := make(chan string, 2)
+	pushes := make(chan string, 4)
+	errs := make(chan uint32, 1)
+	if err := NewClient().Connect(); err == nil {
+		t.Fatal("connected without addrs")
+	}
+
+	client := NewClient(server.Addr)
+	client.ConnectInterval = 10 * time.Millisecond
+	client.Version = 3
+	client.Login = func(client *Client) error {
+		resp, err := client.Request(1, &descriptorpb.FileOptions{}, 0)
+		if err != nil {
+			return err
+		}
+		logins <- resp.(*descriptorpb.FileOptions).GetJavaPackage()
+		return nil
+	}
+	client.OnError = func(msgId uint32, err *processor.CodeError) {
+		if err.Code == processor.ERROR_CODE_UNKNOWN_MSG {
+			errs <- msgId
+		}
+	}
+	client.RegisterResponse(2, &descriptorpb.FileOptions{})
+	client.RegisterPush(4, &descriptorpb.FileOptions{}, func(msg proto.Message) {
+		pushes <- msg.(*descriptorpb.FileOptions).GetJavaPackage()
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if login := <-logins; login != "welcome" {
+		t.Fatalf("login %v", login)
+	}
+	if version, _ := client.ServerVersion(); version != 2 {
+		t.Fatalf("version %v", version)
+	}
+	if push := <-pushes; push != "offline" {
+		t.Fatalf("push %v", push)
+	}
+
+	var codeErr *processor.CodeError
+	if _, err := client.Request(3, &descriptorpb.FileOptions{}, 0); !errors.As(err, &codeErr) || codeErr.Code != 100 {
+		t.Fatalf("request error %v", err)
+	}
+	if _, err := client.Request(5, &descriptorpb.FileOptions{}, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error %v", err)
+	}
+
+	// a retry with the seq of the first try gets its reply again
+	seq := client.NextSeq()
+	for i := 0; i < 2; i++ {
+		resp, err := client.RequestSeq(7, seq, &descriptorpb.FileOptions{}, 0)
+		if err != nil || resp.(*descriptorpb.FileOptions).GetJavaPackage() != "1" {
+			t.Fatalf("buy %v, err %v", resp, err)
+		}
+	}
+	if err := client.Send(99, &descriptorpb.FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgId := <-errs; msgId != 99 {
+		t.Fatalf("error of msgId %v", msgId)
+	}
+
+	// log in again after a reconnect, the acked push is not sent again
+	server.kick()
+	select {
+	case <-logins:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect timeout")
+	}
+	server.processor.SendReliable(100, 4, &descriptorpb.FileOptions{JavaPackage: proto.String("online")})
+	if push := <-pushes; push != "online" {
+		t.Fatalf("push %v", push)
+	}
+}
@@ -0,0 +1,335 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gameserver/core/log"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// capture file
+// -------------------------------------
+// | magic | version | start unix nano |
+// -------------------------------------
+// followed by records, all integers are uvarint
+// ---------------------------------------------------------
+// | time since start | conn id | dir | seq | len | frame |
+// ---------------------------------------------------------
+// frame is the message data without the len head of MsgParser and without
+// the seq head of conns with SeqHeader, seq is 0 for the others
+const captureMagic = "GSCP"
+const captureVersion = 2
+
+// the default MaxRecordLen of a Replayer
+const MAX_CAPTURE_RECORD_LEN = 16 * 1024 * 1024
+
+// frame direction, seen from the server
+const (
+	DirInbound = iota + 1
+	DirOutbound
+)
+
+type CaptureRecord struct {
+	Time   time.Duration
+	ConnId uint64
+	Dir    int
+	Seq    uint32
+	Data   []byte
+}
+
+// anything able to dispatch a frame, such as a processor.Processor
+type MsgRouter interface {
+	Route(clientId uint64, msgData []byte)
+}
+
+//********************************************************
+// recorder
+//********************************************************
+
+// goroutine safe
+type Recorder struct {
+	sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	start  time.Time
+	buf    [5 * binary.MaxVarintLen64]byte
+	err    error
+}
+
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	recorder := &Recorder{
+		w:     bufio.NewWriter(w),
+		start: time.Now(),
+	}
+
+	head := make([]byte, 0, len(captureMagic)+1+binary.MaxVarintLen64)
+	head = append(head, captureMagic...)
+	head = append(head, captureVersion)
+	n := binary.PutUvarint(recorder.buf[:], uint64(recorder.start.UnixNano()))
+	head = append(head, recorder.buf[:n]...)
+	if _, err := recorder.w.Write(head); err != nil {
+		return nil, err
+	}
+
+	return recorder, nil
+}
+
+func CreateRecorder(fileName string) (*Recorder, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder, err := NewRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	recorder.closer = f
+
+	return recorder, nil
+}
+
+// args are joined into one frame
+func (this *Recorder) Record(connId uint64, dir int, seq uint32, args ...[]byte) {
+	now := time.Now()
+
+	var msgLen int
+	for i := 0; i < len(args); i++ {
+		msgLen += len(args[i])
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	if this.err != nil {
+		return
+	}
+
+	n := binary.PutUvarint(this.buf[:], uint64(now.Sub(this.start)))
+	n += binary.PutUvarint(this.buf[n:], connId)
+	n += binary.PutUvarint(this.buf[n:], uint64(dir))
+	n += binary.PutUvarint(this.buf[n:], uint64(seq))
+	n += binary.PutUvarint(this.buf[n:], uint64(msgLen))
+	this.w.Write(this.buf[:n])
+	for i := 0; i < len(args); i++ {
+		this.w.Write(args[i])
+	}
+
+	// bufio keeps the first error
+	if _, err := this.w.Write(nil); err != nil {
+		this.err = err
+		log.Error("capture stopped: %v", err)
+	}
+}
+
+func (this *Recorder) Flush() error {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.w.Flush()
+}
+
+func (this *Recorder) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	err := this.w.Flush()
+	if this.err == nil {
+		this.err = errors.New("recorder is closed")
+	}
+	if this.closer != nil {
+		if cerr := this.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+//********************************************************
+// replayer
+//********************************************************
+
+type Replayer struct {
+	r      *bufio.Reader
+	closer io.Closer
+	Start  time.Time
+
+	// Next fails on a longer frame instead of allocating it
+	MaxRecordLen uint64
+}
+
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	replayer := &Replayer{
+		r:            bufio.NewReader(r),
+		MaxRecordLen: MAX_CAPTURE_RECORD_LEN,
+	}
+
+	head := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(replayer.r, head); err != nil {
+		return nil, err
+	}
+	if string(head[:len(captureMagic)]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+	if head[len(captureMagic)] != captureVersion {
+		return nil, errors.New("unsupported capture version")
+	}
+
+	start, err := binary.ReadUvarint(replayer.r)
+	if err != nil {
+		return nil, err
+	}
+	replayer.Start = time.Unix(0, int64(start))
+
+	return replayer, nil
+}
+
+func OpenReplayer(fileName string) (*Replayer, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	replayer, err := NewReplayer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	replayer.closer = f
+
+	return replayer, nil
+}
+
+func (this *Replayer) Close() error {
+	if this.closer != nil {
+		return this.closer.Close()
+	}
+	return nil
+}
+
+// return io.EOF after the last record
+func (this *Replayer) Next() (*CaptureRecord, error) {
+	var head [5]uint64
+	for i := 0; i < len(head); i++ {
+		v, err := binary.ReadUvarint(this.r)
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		head[i] = v
+	}
+
+	if head[4] > this.MaxRecordLen {
+		return nil, fmt.Errorf("capture record too long: %v", head[4])
+	}
+
+	record := &CaptureRecord{
+		Time:   time.Duration(head[0]),
+		ConnId: head[1],
+		Dir:    int(head[2]),
+		Seq:    uint32(head[3]),
+		Data:   make([]byte, head[4]),
+	}
+	if _, err := io.ReadFull(this.r, record.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// call f for every record, speed 1 keeps the original timing, 2 plays twice
+// as fast and so on, speed <= 0 plays without waiting
+func (this *Replayer) Replay(speed float64, f func(record *CaptureRecord)) error {
+	begin := time.Now()
+	for {
+		record, err := this.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if speed > 0 {
+			at := time.Duration(float64(record.Time) / speed)
+			if d := at - time.Since(begin); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		f(record)
+	}
+}
+
+// feed the inbound frames to router, the conn id is used as client id
+func (this *Replayer) ReplayToRouter(speed float64, router MsgRouter) error {
+	return this.Replay(speed, func(record *CaptureRecord) {
+		if record.Dir == DirInbound {
+			router.Route(record.ConnId, record.Data)
+		}
+	})
+}
+
+// open one connection to addr per captured conn and send the inbound frames
+// through it, msgParser and seqHeader must match the server settings. with
+// seqHeader the frames carry their captured seq
+func (this *Replayer) ReplayToServer(speed float64, addr string, msgParser *MsgParser, seqHeader bool) error {
+	conns := make(map[uint64]*TCPConn)
+	defer func() {
+		for _, tcpConn := range conns {
+			tcpConn.Close()
+		}
+	}()
+
+	var err error
+	replayErr := this.Replay(speed, func(record *CaptureRecord) {
+		if record.Dir != DirInbound || err != nil {
+			return
+		}
+
+		tcpConn, ok := conns[record.ConnId]
+		if !ok {
+			var conn net.Conn
+			conn, err = net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+
+			tcpConn = newTCPConn(conn, 1000, msgParser)
+			if seqHeader {
+				tcpConn.enableSeq()
+			}
+			conns[record.ConnId] = tcpConn
+
+			// drain the replies
+			go func() {
+				for {
+					if _, err := tcpConn.readFrame(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+
+		if seqHeader {
+			err = tcpConn.writeFrame(tcpConn.seqHead(record.Seq), record.Data)
+		} else {
+			err = tcpConn.writeFrame(record.Data)
+		}
+	})
+	if replayErr != nil {
+		return replayErr
+	}
+
+	return err
+}
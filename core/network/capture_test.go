@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type recordRouter struct {
+	clientIds []uint64
+	msgs      []string
+}
+
+func (this *recordRouter) Route(clientId uint64, msgData []byte) {
+	this.clientIds = append(this.clientIds, clientId)
+	this.msgs = append(this.msgs, string(msgData))
+}
+
+func TestCaptureReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record(1, DirInbound, 0, []byte("login"))
+	recorder.Record(1, DirOutbound, 0, []byte("ok"))
+	recorder.Record(2, DirInbound, 0, []byte("mo"), []byte("ve"))
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &recordRouter{}
+	if err := replayer.ReplayToRouter(0, router); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(router.msgs) != 2 || router.msgs[0] != "login" || router.msgs[1] != "move" {
+		t.Fatalf("msgs %q", router.msgs)
+	}
+	if router.clientIds[0] != 1 || router.clientIds[1] != 2 {
+		t.Fatalf("clientIds %v", router.clientIds)
+	}
+}
+
+func TestCaptureRecordTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, _ := NewRecorder(&buf)
+	recorder.Record(1, DirInbound, 0, []byte("login"))
+	recorder.Close()
+
+	replayer, err := NewReplayer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer.MaxRecordLen = 4
+	if _, err := replayer.Next(); err == nil {
+		t.Fatal("record longer than MaxRecordLen read")
+	}
+}
+
+func TestCaptureSeqHeader(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &TCPServer{
+		Addr:      "127.0.0.1:0",
+		SeqHeader: true,
+		Recorder:  recorder,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.Start()
+
+	connected := make(chan struct{}, 1)
+	client := &TCPClient{
+		Addr:      server.ln.Addr().String(),
+		SeqHeader: true,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &testAgent{conn: conn}
+		},
+		OnStateChange: func(addr string, state int) {
+			if state == ClientConnected {
+				connected <- struct{}{}
+			}
+		},
+	}
+	client.Start()
+	<-connected
+	if _, err := client.Call(time.Second, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close(true)
+	server.Close()
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*CaptureRecord
+	replayer.Replay(0, func(record *CaptureRecord) {
+		records = append(records, record)
+	})
+	if len(records) != 2 || records[0].Seq != 1 || records[1].Seq != 1|seqResponseFlag ||
+		string(records[0].Data) != "hello" || string(records[1].Data) != "hello" {
+		t.Fatalf("records %+v", records)
+	}
+
+	replayer, err = NewReplayer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &recordRouter{}
+	if err := replayer.ReplayToRouter(0, router); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.msgs) != 1 || router.msgs[0] != "hello" {
+		t.Fatalf("msgs %q", router.msgs)
+	}
+}
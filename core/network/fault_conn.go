@@ -0,0 +1,199 @@
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrFaultDisconnect = errors.New("fault injection: disconnect")
+
+// rates are probabilities in [0, 1] checked on every read and write
+type FaultConfig struct {
+	Latency   time.Duration
+	Jitter    time.Duration
+	Bandwidth int // bytes per second, 0 means unlimited
+
+	StallRate float64
+	StallTime time.Duration
+
+	DisconnectRate   float64
+	PartialWriteRate float64
+	// the pause between the two halves of a partial write
+	PartialWriteDelay time.Duration
+}
+
+// goroutine safe, can be changed while conns are running
+type FaultInjector struct {
+	sync.RWMutex
+	config FaultConfig
+	// atomic, checked without the lock so a disabled injector costs a load
+	enabled int32
+}
+
+func NewFaultInjector(config FaultConfig) *FaultInjector {
+	return &FaultInjector{
+		config:  config,
+		enabled: 1,
+	}
+}
+
+func (this *FaultInjector) Set(config FaultConfig) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.config = config
+	atomic.StoreInt32(&this.enabled, 1)
+}
+
+func (this *FaultInjector) Enable(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&this.enabled, 1)
+	} else {
+		atomic.StoreInt32(&this.enabled, 0)
+	}
+}
+
+func (this *FaultInjector) Config() (FaultConfig, bool) {
+	if atomic.LoadInt32(&this.enabled) == 0 {
+		return FaultConfig{}, false
+	}
+
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.config, true
+}
+
+// net.Conn with faults, the conn's own injector overrides the shared one
+// while it is enabled
+type FaultConn struct {
+	net.Conn
+	shared *FaultInjector
+	own    FaultInjector
+}
+
+func NewFaultConn(conn net.Conn, shared *FaultInjector) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		shared: shared,
+	}
+}
+
+// every conn is wrapped so faults can be injected into one of them without a
+// shared injector, while both injectors are disabled the cost is two atomic
+// loads per read and write
+func wrapFault(conn net.Conn, shared *FaultInjector) net.Conn {
+	return NewFaultConn(conn, shared)
+}
+
+// per conn settings, disabled until Set or Enable is called
+func (this *FaultConn) Injector() *FaultInjector {
+	return &this.own
+}
+
+func (this *FaultConn) config() (FaultConfig, bool) {
+	if config, ok := this.own.Config(); ok {
+		return config, true
+	}
+	if this.shared != nil {
+		return this.shared.Config()
+	}
+	return FaultConfig{}, false
+}
+
+func hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (this *FaultConn) disconnect(config *FaultConfig) error {
+	if hit(config.DisconnectRate) {
+		this.Conn.Close()
+		return ErrFaultDisconnect
+	}
+	return nil
+}
+
+func (this *FaultConn) delay(config *FaultConfig) {
+	d := config.Latency
+	if config.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(config.Jitter)))
+	}
+	if hit(config.StallRate) {
+		d += config.StallTime
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (this *FaultConn) throttle(config *FaultConfig, n int) {
+	if config.Bandwidth > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(config.Bandwidth))
+	}
+}
+
+func (this *FaultConn) Read(b []byte) (int, error) {
+	config, ok := this.config()
+	if !ok {
+		return this.Conn.Read(b)
+	}
+
+	if err := this.disconnect(&config); err != nil {
+		return 0, err
+	}
+
+	// the data is held back once it has arrived, a read waiting for data
+	// is not delayed
+	n, err := this.Conn.Read(b)
+	if n > 0 {
+		this.delay(&config)
+		this.throttle(&config, n)
+	}
+
+	return n, err
+}
+
+func (this *FaultConn) Write(b []byte) (int, error) {
+	config, ok := this.config()
+	if !ok {
+		return this.Conn.Write(b)
+	}
+
+	if err := this.disconnect(&config); err != nil {
+		return 0, err
+	}
+	this.delay(&config)
+
+	// split the write so the peer sees a partial message for a while
+	if len(b) > 1 && hit(config.PartialWriteRate) {
+		half := 1 + rand.Intn(len(b)-1)
+		n, err := this.Conn.Write(b[:half])
+		if err != nil {
+			return n, err
+		}
+		this.throttle(&config, n)
+		if config.PartialWriteDelay > 0 {
+			time.Sleep(config.PartialWriteDelay)
+		}
+
+		m, err := this.Conn.Write(b[half:])
+		this.throttle(&config, m)
+		return n + m, err
+	}
+
+	n, err := this.Conn.Write(b)
+	this.throttle(&config, n)
+
+	return n, err
+}
+
+func (this *FaultConn) SetLinger(sec int) error {
+	if tcpConn, ok := this.Conn.(*net.TCPConn); ok {
+		return tcpConn.SetLinger(sec)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaultConnWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		shared  *FaultConfig
+		own     *FaultConfig
+		disable bool // disable own after Set
+		size    int
+		err     error
+		minCost time.Duration
+	}{
+		{name: "none", size: 10},
+		{name: "latency", shared: &FaultConfig{Latency: 30 * time.Millisecond}, size: 10, minCost: 30 * time.Millisecond},
+		{name: "disconnect", shared: &FaultConfig{DisconnectRate: 1}, size: 10, err: ErrFaultDisconnect},
+		{name: "bandwidth", shared: &FaultConfig{Bandwidth: 1000}, size: 50, minCost: 50 * time.Millisecond},
+		{name: "partial write", shared: &FaultConfig{PartialWriteRate: 1, PartialWriteDelay: 30 * time.Millisecond}, size: 10, minCost: 30 * time.Millisecond},
+		{name: "own overrides", shared: &FaultConfig{DisconnectRate: 1}, own: &FaultConfig{}, size: 10},
+		{name: "own only", own: &FaultConfig{DisconnectRate: 1}, size: 10, err: ErrFaultDisconnect},
+		{name: "own disabled", shared: &FaultConfig{DisconnectRate: 1}, own: &FaultConfig{}, disable: true, size: 10, err: ErrFaultDisconnect},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			local, peer := net.Pipe()
+			defer peer.Close()
+
+			var shared *FaultInjector
+			if test.shared != nil {
+				shared = NewFaultInjector(*test.shared)
+			}
+			conn := wrapFault(local, shared).(*FaultConn)
+			defer conn.Close()
+			if test.own != nil {
+				conn.Injector().Set(*test.own)
+			}
+			if test.disable {
+				conn.Injector().Enable(false)
+			}
+
+			received := make(chan int, 1)
+			go func() {
+				n, _ := io.ReadFull(peer, make([]byte, test.size))
+				received <- n
+			}()
+
+			start := time.Now()
+			n, err := conn.Write(make([]byte, test.size))
+			cost := time.Since(start)
+			if err != test.err {
+				t.Fatalf("err %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if n != test.size || <-received != test.size {
+				t.Fatalf("wrote %v, want %v", n, test.size)
+			}
+			if cost < test.minCost {
+				t.Fatalf("cost %v, want at least %v", cost, test.minCost)
+			}
+		})
+	}
+}
+
+// latency is added to the data after it arrives
+func TestFaultConnReadLatency(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+	conn := wrapFault(local, NewFaultInjector(FaultConfig{Latency: 30 * time.Millisecond}))
+	defer conn.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		peer.Write([]byte("x"))
+	}()
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 80*time.Millisecond {
+		t.Fatalf("cost %v, want at least 80ms", cost)
+	}
+}
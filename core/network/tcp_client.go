@@ -1,23 +1,58 @@
 package network
 
 import (
+	"context"
 	"gameserver/core/log"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
 )
 
+// endpoint select mode
+const (
+	FailoverRoundRobin = iota
+	FailoverPriority
+)
+
+// client conn state
+const (
+	ClientConnecting = iota
+	ClientConnected
+	ClientDisconnected
+	ClientGaveUp
+)
+
 type TCPClient struct {
 	sync.Mutex
 	Addr            string
+	Addrs           []string
+	FailoverMode    int
 	ConnNum         int
 	ConnectInterval time.Duration
 	PendingWriteNum int
 	AutoReconnect   bool
 	NewAgent        func(*TCPConn) Agent
+	SeqHeader       bool
+	Fault           *FaultInjector
 	cons            ConnSet
+	tcpConns        []*TCPConn
+	nextConn        int
 	wg              sync.WaitGroup
 	closeFlag       bool
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	// backoff, the delay doubles after each failed round over Addrs up to
+	// MaxConnectInterval. MaxRetry is the number of redials after the first
+	// failed dial before giving up, 0 means retry forever
+	MaxConnectInterval time.Duration
+	Jitter             float64
+	MaxRetry           int
+	DialTimeout        time.Duration
+
+	// called from the connect goroutine, must not block
+	OnStateChange func(addr string, state int)
 
 	// msg parser
 	LenMsgLen    int
@@ -32,7 +67,7 @@ func (this *TCPClient) Start() {
 
 	for i := 0; i < this.ConnNum; i++ {
 		this.wg.Add(1)
-		go this.connect()
+		go this.connect(i)
 	}
 }
 
@@ -44,10 +79,23 @@ func (this *TCPClient) init() {
 		this.ConnNum = 1
 		log.Info("invalid ConnNum, reset to %v", this.ConnNum)
 	}
+	if len(this.Addrs) == 0 {
+		if this.Addr == "" {
+			log.Fatal("Addr or Addrs must be set")
+		}
+		this.Addrs = []string{this.Addr}
+	}
 	if this.ConnectInterval <= 0 {
 		this.ConnectInterval = 3 * time.Second
 		log.Info("invalid ConnectInterval, reset to %v", this.ConnectInterval)
 	}
+	if this.MaxConnectInterval < this.ConnectInterval {
+		this.MaxConnectInterval = this.ConnectInterval
+	}
+	if this.Jitter < 0 || this.Jitter > 1 {
+		this.Jitter = 0
+		log.Info("invalid Jitter, reset to %v", this.Jitter)
+	}
 	if this.PendingWriteNum <= 0 {
 		this.PendingWriteNum = 1000
 		log.Info("invalid PendingWriteNum, reset to %v", this.PendingWriteNum)
@@ -61,6 +109,7 @@ func (this *TCPClient) init() {
 
 	this.cons = make(ConnSet)
 	this.closeFlag = false
+	this.ctx, this.cancel = context.WithCancel(context.Background())
 
 	// msg parser
 	msgParser := NewMsgParser()
@@ -69,27 +118,96 @@ func (this *TCPClient) init() {
 	this.msgParser = msgParser
 }
 
-func (this *TCPClient) dial() net.Conn {
-	for {
-		conn, err := net.Dial("tcp", this.Addr)
-		if this.closeFlag {
-			return conn
+func (this *TCPClient) setState(addr string, state int) {
+	if this.OnStateChange != nil {
+		this.OnStateChange(addr, state)
+	}
+}
+
+// delay before the retry-th redial: ConnectInterval * 2^retry, capped and jittered
+func (this *TCPClient) backoff(retry int) time.Duration {
+	d := this.ConnectInterval
+	for i := 0; i < retry && d < this.MaxConnectInterval; i++ {
+		d *= 2
+	}
+	if d > this.MaxConnectInterval {
+		d = this.MaxConnectInterval
+	}
+	if this.Jitter > 0 {
+		delta := float64(d) * this.Jitter
+		d = d - time.Duration(delta) + time.Duration(rand.Float64()*2*delta)
+	}
+
+	return d
+}
+
+// return false if the client is closed while waiting
+func (this *TCPClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-this.ctx.Done():
+		return false
+	}
+}
+
+// next is the index of the endpoint to try first, it is advanced past the
+// endpoint that was connected
+func (this *TCPClient) dial(next *int) (net.Conn, string) {
+	dialer := net.Dialer{Timeout: this.DialTimeout}
+	for retry := 0; ; retry++ {
+		addr := this.Addrs[*next%len(this.Addrs)]
+		this.setState(addr, ClientConnecting)
+
+		conn, err := dialer.DialContext(this.ctx, "tcp", addr)
+		if this.ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, addr
 		} else if err == nil && conn != nil {
 			conn.(*net.TCPConn).SetNoDelay(true)
-			return conn
+			if this.FailoverMode == FailoverRoundRobin {
+				*next++
+			}
+			return conn, addr
+		}
+
+		log.Info("connect to %v error: %v", addr, err)
+		*next++
+		if this.MaxRetry > 0 && retry >= this.MaxRetry {
+			log.Warn("connect gave up after %v retries", retry)
+			this.setState(addr, ClientGaveUp)
+			return nil, addr
 		}
 
-		log.Info("connect to %v error: %v", this.Addr, err)
-		time.Sleep(this.ConnectInterval)
-		continue
+		// try every endpoint once before backing off
+		if (retry+1)%len(this.Addrs) != 0 {
+			continue
+		}
+		if !this.sleep(this.backoff(retry / len(this.Addrs))) {
+			return nil, addr
+		}
 	}
 }
 
-func (this *TCPClient) connect() {
+func (this *TCPClient) connect(idx int) {
 	defer this.wg.Done()
 
+	// spread connections over the endpoints in round-robin mode
+	next := 0
+	if this.FailoverMode == FailoverRoundRobin {
+		next = idx
+	}
+
 reconnect:
-	conn := this.dial()
+	if this.FailoverMode == FailoverPriority {
+		next = 0
+	}
+	conn, addr := this.dial(&next)
 	if conn == nil {
 		return
 	}
@@ -101,9 +219,14 @@ reconnect:
 		return
 	}
 	this.cons[conn] = struct{}{}
+	tcpConn := newTCPConn(wrapFault(conn, this.Fault), this.PendingWriteNum, this.msgParser)
+	if this.SeqHeader {
+		tcpConn.enableSeq()
+	}
+	this.tcpConns = append(this.tcpConns, tcpConn)
 	this.Unlock()
+	this.setState(addr, ClientConnected)
 
-	tcpConn := newTCPConn(conn, this.PendingWriteNum, this.msgParser)
 	agent := this.NewAgent(tcpConn)
 	agent.Run()
 
@@ -111,11 +234,17 @@ reconnect:
 	tcpConn.Close()
 	this.Lock()
 	delete(this.cons, conn)
+	for i, c := range this.tcpConns {
+		if c == tcpConn {
+			this.tcpConns = append(this.tcpConns[:i], this.tcpConns[i+1:]...)
+			break
+		}
+	}
 	this.Unlock()
 	agent.OnClose()
+	this.setState(addr, ClientDisconnected)
 
-	if this.AutoReconnect {
-		time.Sleep(this.ConnectInterval)
+	if this.AutoReconnect && this.sleep(this.ConnectInterval) {
 		goto reconnect
 	}
 }
@@ -123,10 +252,14 @@ reconnect:
 func (this *TCPClient) Close(waitDone bool) {
 	this.Lock()
 	this.closeFlag = true
+	if this.cancel != nil {
+		this.cancel()
+	}
 	for conn := range this.cons {
 		conn.Close()
 	}
 	this.cons = nil
+	this.tcpConns = nil
 	this.Unlock()
 
 	if waitDone == true {
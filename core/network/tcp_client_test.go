@@ -0,0 +1,193 @@
+package network
+
+import (
+	"gameserver/core/log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.InitLog(os.TempDir(), "error", false, 0)
+}
+
+type testAgent struct {
+	conn *TCPConn
+}
+
+func (this *testAgent) Run() {
+	for {
+		if _, err := this.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (this *testAgent) OnClose() {}
+
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTCPClientFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	connected := make(chan string, 1)
+	client := &TCPClient{
+		Addrs:           []string{unusedAddr(t), ln.Addr().String()},
+		FailoverMode:    FailoverPriority,
+		ConnectInterval: 10 * time.Millisecond,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &testAgent{conn: conn}
+		},
+		OnStateChange: func(addr string, state int) {
+			if state == ClientConnected {
+				connected <- addr
+			}
+		},
+	}
+	client.Start()
+	defer client.Close(true)
+
+	select {
+	case addr := <-connected:
+		if addr != ln.Addr().String() {
+			t.Fatalf("connected to %v, want %v", addr, ln.Addr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failover timeout")
+	}
+}
+
+func TestTCPClientGiveUpAndClose(t *testing.T) {
+	var mutex sync.Mutex
+	var states []int
+	client := &TCPClient{
+		Addr:            unusedAddr(t),
+		ConnectInterval: 5 * time.Millisecond,
+		MaxRetry:        3,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &testAgent{conn: conn}
+		},
+		OnStateChange: func(addr string, state int) {
+			mutex.Lock()
+			states = append(states, state)
+			mutex.Unlock()
+		},
+	}
+	client.Start()
+	client.wg.Wait()
+
+	mutex.Lock()
+	if len(states) == 0 || states[len(states)-1] != ClientGaveUp {
+		t.Fatalf("states %v, want last %v", states, ClientGaveUp)
+	}
+	// the first dial and 3 retries
+	dials := 0
+	for _, state := range states {
+		if state == ClientConnecting {
+			dials++
+		}
+	}
+	if dials != 4 {
+		t.Fatalf("dials %v, want 4", dials)
+	}
+	mutex.Unlock()
+	client.Close(true)
+
+	// close must interrupt a long backoff
+	client = &TCPClient{
+		Addr:            unusedAddr(t),
+		ConnectInterval: time.Hour,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &testAgent{conn: conn}
+		},
+	}
+	client.Start()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	client.Close(true)
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("close took %v", cost)
+	}
+}
+
+type echoAgent struct {
+	conn *TCPConn
+}
+
+func (this *echoAgent) Run() {
+	for {
+		seq, msgData, err := this.conn.ReadRequest()
+		if err != nil {
+			return
+		}
+		// "drop" closes the conn without replying
+		if string(msgData) == "drop" {
+			this.conn.Close()
+			return
+		}
+		this.conn.WriteResponse(seq, msgData)
+	}
+}
+
+func (this *echoAgent) OnClose() {}
+
+func TestTCPClientCall(t *testing.T) {
+	server := &TCPServer{
+		Addr:      "127.0.0.1:0",
+		SeqHeader: true,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	connected := make(chan struct{}, 1)
+	client := &TCPClient{
+		Addr:            server.ln.Addr().String(),
+		SeqHeader:       true,
+		AutoReconnect:   true,
+		ConnectInterval: 10 * time.Millisecond,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &testAgent{conn: conn}
+		},
+		OnStateChange: func(addr string, state int) {
+			if state == ClientConnected {
+				connected <- struct{}{}
+			}
+		},
+	}
+	client.Start()
+	defer client.Close(true)
+	<-connected
+
+	reply, err := client.Call(time.Second, []byte("hello"))
+	if err != nil || string(reply) != "hello" {
+		t.Fatalf("reply %q, err %v", reply, err)
+	}
+
+	if _, err := client.Call(time.Second, []byte("drop")); err != ErrConnClosed {
+		t.Fatalf("err %v, want %v", err, ErrConnClosed)
+	}
+
+	<-connected
+	reply, err = client.Call(time.Second, []byte("again"))
+	if err != nil || string(reply) != "again" {
+		t.Fatalf("reply %q, err %v", reply, err)
+	}
+}
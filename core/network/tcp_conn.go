@@ -1,25 +1,36 @@
 package network
 
 import (
-	"fmt"
+	"gameserver/common/utils"
 	"gameserver/core/log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ConnSet map[net.Conn]struct{}
 
+var connIdSeq uint64
+
 type TCPConn struct {
 	sync.Mutex
+	id        uint64
 	conn      net.Conn
 	writeChan chan []byte
 	closeFlag bool
 	msgParser *MsgParser
+
+	// not nil if frames carry a seq header
+	pending *pendingCalls
+
+	// not nil if traffic is captured
+	recorder *Recorder
 }
 
 func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
 	tcpConn := new(TCPConn)
+	tcpConn.id = atomic.AddUint64(&connIdSeq, 1)
 	tcpConn.conn = conn
 	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
 	tcpConn.msgParser = msgParser
@@ -43,13 +54,18 @@ func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPCo
 }
 
 func (this *TCPConn) doDestroy() {
-	this.conn.(*net.TCPConn).SetLinger(0)
+	if conn, ok := this.conn.(interface{ SetLinger(sec int) error }); ok {
+		conn.SetLinger(0)
+	}
 	this.conn.Close()
 
 	if !this.closeFlag {
 		close(this.writeChan)
 		this.closeFlag = true
 	}
+	if this.pending != nil {
+		this.pending.closeAll(ErrConnClosed)
+	}
 }
 
 func (this *TCPConn) Destroy() {
@@ -62,6 +78,9 @@ func (this *TCPConn) Destroy() {
 func (this *TCPConn) Close() {
 	this.Lock()
 	defer this.Unlock()
+	if this.pending != nil {
+		this.pending.closeAll(ErrConnClosed)
+	}
 	if this.closeFlag {
 		return
 	}
@@ -103,21 +122,75 @@ func (this *TCPConn) RemoteAddr() net.Addr {
 	return this.conn.RemoteAddr()
 }
 
+// unique in the process, stable for the lifetime of the conn
+func (this *TCPConn) ID() uint64 {
+	return this.id
+}
+
+func (this *TCPConn) readFrame() ([]byte, error) {
+	msgData, err := this.msgParser.Read(this)
+	if err == nil && this.recorder != nil {
+		this.record(DirInbound, msgData)
+	}
+	return msgData, err
+}
+
+func (this *TCPConn) writeFrame(args ...[]byte) error {
+	err := this.msgParser.Write(this, args...)
+	if err == nil && this.recorder != nil {
+		this.record(DirOutbound, args...)
+	}
+	return err
+}
+
+// the seq head is recorded apart so the frame replays as the msg alone
+func (this *TCPConn) record(dir int, args ...[]byte) {
+	if this.pending == nil || len(args) == 0 {
+		this.recorder.Record(this.id, dir, 0, args...)
+		return
+	}
+
+	// a read frame is one arg, a written one starts with the seq head
+	if len(args[0]) < SEQ_LEN {
+		this.recorder.Record(this.id, dir, 0, args...)
+		return
+	}
+	seq := utils.ByteToUint32(args[0], this.msgParser.littleEndian)
+	args = append([][]byte{args[0][SEQ_LEN:]}, args[1:]...)
+	this.recorder.Record(this.id, dir, seq, args...)
+}
+
 func (this *TCPConn) ReadMsg() ([]byte, error) {
-	return this.msgParser.Read(this)
+	if this.pending != nil {
+		_, msgData, err := this.ReadRequest()
+		return msgData, err
+	}
+	return this.readFrame()
 }
 
 func (this *TCPConn) WriteMsg(args ...[]byte) error {
 	if this.closeFlag == true {
-		return fmt.Errorf("conn is close")
+		return ErrConnClosed
+	}
+	if this.pending != nil {
+		return this.writeFrame(append([][]byte{this.seqHead(0)}, args...)...)
 	}
-	return this.msgParser.Write(this, args...)
+	return this.writeFrame(args...)
 }
 
 func (this *TCPConn) IsConnected() bool {
 	return this.closeFlag == false
 }
 
+// the faults of this conn alone, disabled until Set or Enable is called. nil
+// for conns not made by TCPServer or TCPClient
+func (this *TCPConn) FaultInjector() *FaultInjector {
+	if conn, ok := this.conn.(*FaultConn); ok {
+		return conn.Injector()
+	}
+	return nil
+}
+
 func (this *TCPConn) SetReadDeadline(d time.Duration)  {
 	this.conn.SetReadDeadline(time.Now().Add(d))
 }
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"errors"
+	"gameserver/common/utils"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// | len | seq | data |
+// ---------------------
+// seq is 0 for plain messages, the request id for requests and the request id
+// with the highest bit set for responses
+const SEQ_LEN = 4
+const seqResponseFlag = 1 << 31
+
+var ErrConnClosed = errors.New("conn is close")
+var ErrNotConnected = errors.New("not connected")
+var ErrRequestTimeout = errors.New("request timeout")
+
+// a pending request, Done receives the call itself once Reply or Err is set
+type Call struct {
+	Seq   uint32
+	Reply []byte
+	Err   error
+	Done  chan *Call
+
+	pending *pendingCalls
+}
+
+func (this *Call) done(reply []byte, err error) {
+	this.Reply = reply
+	this.Err = err
+	this.Done <- this
+}
+
+// block until the response arrives, the conn closes or timeout expires,
+// timeout <= 0 means wait forever
+func (this *Call) Wait(timeout time.Duration) ([]byte, error) {
+	if timeout <= 0 {
+		<-this.Done
+		return this.Reply, this.Err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-this.Done:
+		return this.Reply, this.Err
+	case <-timer.C:
+		if this.pending != nil && this.pending.remove(this.Seq) == nil {
+			// completed while timing out
+			<-this.Done
+			return this.Reply, this.Err
+		}
+		return nil, ErrRequestTimeout
+	}
+}
+
+type pendingCalls struct {
+	sync.Mutex
+	seq       uint32
+	calls     map[uint32]*Call
+	closeFlag bool
+}
+
+func newPendingCalls() *pendingCalls {
+	return &pendingCalls{
+		calls: make(map[uint32]*Call),
+	}
+}
+
+func (this *pendingCalls) add() *Call {
+	call := &Call{
+		Done:    make(chan *Call, 1),
+		pending: this,
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	if this.closeFlag {
+		call.done(nil, ErrConnClosed)
+		return call
+	}
+
+	// skip 0 and the response flag
+	this.seq = (this.seq + 1) &^ seqResponseFlag
+	if this.seq == 0 {
+		this.seq = 1
+	}
+	call.Seq = this.seq
+	this.calls[call.Seq] = call
+
+	return call
+}
+
+func (this *pendingCalls) remove(seq uint32) *Call {
+	this.Lock()
+	defer this.Unlock()
+
+	call, ok := this.calls[seq]
+	if !ok {
+		return nil
+	}
+	delete(this.calls, seq)
+
+	return call
+}
+
+func (this *pendingCalls) closeAll(err error) {
+	this.Lock()
+	calls := this.calls
+	this.calls = make(map[uint32]*Call)
+	this.closeFlag = true
+	this.Unlock()
+
+	for _, call := range calls {
+		call.done(nil, err)
+	}
+}
+
+//********************************************************
+// conn
+//********************************************************
+
+// It's dangerous to call the method after the conn is handed to an agent
+func (this *TCPConn) enableSeq() {
+	this.pending = newPendingCalls()
+}
+
+func (this *TCPConn) seqHead(seq uint32) []byte {
+	head := make([]byte, SEQ_LEN)
+	utils.PutUint32ToByte(head, seq, this.msgParser.littleEndian)
+	return head
+}
+
+// read the next request or plain message, responses are delivered to their
+// pending calls and skipped
+func (this *TCPConn) ReadRequest() (uint32, []byte, error) {
+	if this.pending == nil {
+		return 0, nil, errors.New("seq header not enabled")
+	}
+
+	for {
+		msgData, err := this.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(msgData) < SEQ_LEN {
+			return 0, nil, errors.New("message too short")
+		}
+
+		seq := utils.ByteToUint32(msgData, this.msgParser.littleEndian)
+		if seq&seqResponseFlag == 0 {
+			return seq, msgData[SEQ_LEN:], nil
+		}
+
+		if call := this.pending.remove(seq &^ seqResponseFlag); call != nil {
+			call.done(msgData[SEQ_LEN:], nil)
+		}
+	}
+}
+
+// reply to a request read by ReadRequest
+func (this *TCPConn) WriteResponse(seq uint32, args ...[]byte) error {
+	if this.pending == nil {
+		return errors.New("seq header not enabled")
+	}
+	if this.closeFlag == true {
+		return ErrConnClosed
+	}
+
+	return this.writeFrame(append([][]byte{this.seqHead(seq | seqResponseFlag)}, args...)...)
+}
+
+// send a request, the call fails with ErrConnClosed if the conn closes first
+func (this *TCPConn) Request(args ...[]byte) *Call {
+	if this.pending == nil {
+		call := &Call{Done: make(chan *Call, 1)}
+		call.done(nil, errors.New("seq header not enabled"))
+		return call
+	}
+
+	call := this.pending.add()
+	if call.Err != nil {
+		return call
+	}
+
+	var err error
+	if this.closeFlag == true {
+		err = ErrConnClosed
+	} else {
+		err = this.writeFrame(append([][]byte{this.seqHead(call.Seq)}, args...)...)
+	}
+	if err != nil && this.pending.remove(call.Seq) != nil {
+		call.done(nil, err)
+	}
+
+	return call
+}
+
+//********************************************************
+// client
+//********************************************************
+
+// send a request on one of the connected conns in turn
+func (this *TCPClient) Request(args ...[]byte) *Call {
+	this.Lock()
+	var tcpConn *TCPConn
+	if len(this.tcpConns) > 0 {
+		this.nextConn = (this.nextConn + 1) % len(this.tcpConns)
+		tcpConn = this.tcpConns[this.nextConn]
+	}
+	this.Unlock()
+
+	if tcpConn == nil {
+		call := &Call{Done: make(chan *Call, 1)}
+		call.done(nil, ErrNotConnected)
+		return call
+	}
+
+	return tcpConn.Request(args...)
+}
+
+// send a request and block until the response arrives or timeout expires
+func (this *TCPClient) Call(timeout time.Duration, args ...[]byte) ([]byte, error) {
+	return this.Request(args...).Wait(timeout)
+}
@@ -11,6 +11,9 @@ type TCPServer struct {
 	Addr            string
 	MaxConnNum      int
 	PendingWriteNum int
+	SeqHeader       bool
+	Recorder        *Recorder
+	Fault           *FaultInjector
 	NewAgent        func(*TCPConn) Agent
 	ln              net.Listener
 	conns           ConnSet
@@ -96,7 +99,11 @@ func (this *TCPServer) run() {
 
 		this.wgConns.Add(1)
 
-		tcpConn := newTCPConn(conn, this.PendingWriteNum, this.msgParser)
+		tcpConn := newTCPConn(wrapFault(conn, this.Fault), this.PendingWriteNum, this.msgParser)
+		if this.SeqHeader {
+			tcpConn.enableSeq()
+		}
+		tcpConn.recorder = this.Recorder
 		agent := this.NewAgent(tcpConn)
 		go func() {
 			agent.Run()
@@ -0,0 +1,196 @@
+package processor
+
+import (
+	"errors"
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	utils2 "gameserver/core/utils"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------
+// | BATCH_MSG_ID | len | frame | len | frame | ... |
+// -------------------------------------------------
+// several frames in one, each frame is what Route takes for a single msg
+
+const BATCH_ENTRY_LEN = 4
+
+var ErrBatcherClosed = errors.New("batcher closed")
+
+// frame is the whole batch with msgId
+func (this *PBProcessor) routeBatch(clientId uint64, frame []byte) {
+	msgData := frame[utils2.MSG_ID_LEN:]
+	for len(msgData) > 0 {
+		if len(msgData) < BATCH_ENTRY_LEN {
+			log.Warn("invalid batch, clientId: %v", clientId)
+			this.onBadFrame(clientId, BAD_FRAME_BATCH, BATCH_MSG_ID, frame, false)
+			return
+		}
+		entryLen := int(utils.ByteToUint32(msgData, this.littleEndian))
+		msgData = msgData[BATCH_ENTRY_LEN:]
+		if entryLen < utils2.MSG_ID_LEN || entryLen > len(msgData) {
+			log.Warn("invalid batch entry len: %v, clientId: %v", entryLen, clientId)
+			this.onBadFrame(clientId, BAD_FRAME_BATCH, BATCH_MSG_ID, frame, false)
+			return
+		}
+
+		entry := msgData[:entryLen]
+		msgData = msgData[entryLen:]
+		if utils.ByteToUint32(entry, this.littleEndian) == BATCH_MSG_ID {
+			log.Warn("nested batch, clientId: %v", clientId)
+			this.onBadFrame(clientId, BAD_FRAME_BATCH, BATCH_MSG_ID, frame, false)
+			continue
+		}
+		this.Route(clientId, entry)
+	}
+}
+
+// a batch of the frames made by Marshal and friends
+func (this *PBProcessor) MarshalBatch(frames ...[]byte) []byte {
+	size := utils2.MSG_ID_LEN
+	for _, frame := range frames {
+		size += BATCH_ENTRY_LEN + len(frame)
+	}
+
+	buf := make([]byte, size)
+	utils.PutUint32ToByte(buf, BATCH_MSG_ID, this.littleEndian)
+	l := utils2.MSG_ID_LEN
+	for _, frame := range frames {
+		utils.PutUint32ToByte(buf[l:], uint32(len(frame)), this.littleEndian)
+		l += BATCH_ENTRY_LEN
+		copy(buf[l:], frame)
+		l += len(frame)
+	}
+
+	return buf
+}
+
+// *network.TCPConn for example
+type MsgWriter interface {
+	WriteMsg(args ...[]byte) error
+}
+
+// accumulates the frames to one connection and writes them as one batch when
+// they reach maxSize or interval after the first one, goroutine safe
+type Batcher struct {
+	sync.Mutex
+	writer       MsgWriter
+	littleEndian bool
+	maxSize      int
+	interval     time.Duration
+
+	frames [][]byte
+	size   int
+	timer  *time.Timer
+	closed bool
+}
+
+// maxSize must not be larger than the max msg len of the MsgParser, with
+// interval 0 Flush is left to the caller, once per tick for example
+func (this *PBProcessor) NewBatcher(writer MsgWriter, maxSize int, interval time.Duration) *Batcher {
+	if maxSize <= utils2.MSG_ID_LEN+BATCH_ENTRY_LEN {
+		log.Fatal("invalid batch size: %v", maxSize)
+	}
+
+	return &Batcher{
+		writer:       writer,
+		littleEndian: this.littleEndian,
+		maxSize:      maxSize,
+		interval:     interval,
+	}
+}
+
+// frame is kept until it is written, it must not be modified by the caller
+func (this *Batcher) Write(frame []byte) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.closed {
+		return ErrBatcherClosed
+	}
+
+	entrySize := BATCH_ENTRY_LEN + len(frame)
+	if this.size+entrySize > this.maxSize {
+		if err := this.flush(); err != nil {
+			return err
+		}
+	}
+	if utils2.MSG_ID_LEN+entrySize > this.maxSize {
+		return this.writer.WriteMsg(frame)
+	}
+
+	if len(this.frames) == 0 {
+		this.size = utils2.MSG_ID_LEN
+		if this.interval > 0 {
+			var timer *time.Timer
+			timer = time.AfterFunc(this.interval, func() {
+				this.Lock()
+				defer this.Unlock()
+
+				// fired while the batch was flushed by Write, Flush or Close
+				if this.timer != timer {
+					return
+				}
+				if err := this.flush(); err != nil {
+					log.Debug("flush batch error: %v", err)
+				}
+			})
+			this.timer = timer
+		}
+	}
+	this.frames = append(this.frames, frame)
+	this.size += entrySize
+
+	return nil
+}
+
+func (this *Batcher) Flush() error {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.flush()
+}
+
+func (this *Batcher) flush() error {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+
+	frames := this.frames
+	this.frames = nil
+	this.size = 0
+
+	switch len(frames) {
+	case 0:
+		return nil
+	case 1:
+		return this.writer.WriteMsg(frames[0])
+	}
+
+	args := make([][]byte, 0, 1+2*len(frames))
+	head := make([]byte, utils2.MSG_ID_LEN+BATCH_ENTRY_LEN*len(frames))
+	utils.PutUint32ToByte(head, BATCH_MSG_ID, this.littleEndian)
+	args = append(args, head[:utils2.MSG_ID_LEN])
+	for i, frame := range frames {
+		entryHead := head[utils2.MSG_ID_LEN+i*BATCH_ENTRY_LEN : utils2.MSG_ID_LEN+(i+1)*BATCH_ENTRY_LEN]
+		utils.PutUint32ToByte(entryHead, uint32(len(frame)), this.littleEndian)
+		args = append(args, entryHead, frame)
+	}
+
+	return this.writer.WriteMsg(args...)
+}
+
+// write the pending frames, later writes fail
+func (this *Batcher) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+
+	return this.flush()
+}
@@ -0,0 +1,213 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// kinds of catalog entries
+const (
+	CATALOG_MSG      = "msg"
+	CATALOG_REQUEST  = "request"
+	CATALOG_RESPONSE = "response"
+)
+
+type FieldSchema struct {
+	Name     string `json:"name"`
+	Number   int32  `json:"number"`
+	Type     string `json:"type"`
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+type CatalogEntry struct {
+	MsgId      uint32         `json:"msgId"`
+	Kind       string         `json:"kind"`
+	Name       string         `json:"name"`
+	Handler    string         `json:"handler,omitempty"`
+	RespId     uint32         `json:"respId,omitempty"`
+	MinVersion uint32         `json:"minVersion,omitempty"`
+	Fields     []*FieldSchema `json:"fields"`
+}
+
+func funcName(f interface{}) string {
+	v := reflect.ValueOf(f)
+	if !v.IsValid() || v.IsNil() {
+		return ""
+	}
+	if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
+func fieldType(fd protoreflect.FieldDescriptor) string {
+	if fd.IsMap() {
+		return fmt.Sprintf("map<%v, %v>", fieldType(fd.MapKey()), fieldType(fd.MapValue()))
+	}
+
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return string(fd.Message().FullName())
+	case protoreflect.EnumKind:
+		return string(fd.Enum().FullName())
+	}
+	return fd.Kind().String()
+}
+
+func describe(msgDesc protoreflect.MessageDescriptor) (string, []*FieldSchema) {
+	fields := msgDesc.Fields()
+	result := make([]*FieldSchema, 0, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		result = append(result, &FieldSchema{
+			Name:     string(fd.Name()),
+			Number:   int32(fd.Number()),
+			Type:     fieldType(fd),
+			Repeated: fd.IsList(),
+		})
+	}
+
+	return string(msgDesc.FullName()), result
+}
+
+func (this *MessageInfo) descriptor() protoreflect.MessageDescriptor {
+	if this.msgDesc != nil {
+		return this.msgDesc
+	}
+	return proto.MessageV2(this.allocMessage()).ProtoReflect().Descriptor()
+}
+
+func newCatalogEntry(msgId uint32, kind string, msgDesc protoreflect.MessageDescriptor) *CatalogEntry {
+	entry := &CatalogEntry{
+		MsgId: msgId,
+		Kind:  kind,
+	}
+	entry.Name, entry.Fields = describe(msgDesc)
+	return entry
+}
+
+// every registered msgId sorted by msgId, a msg with version specific
+// handlers has an entry per version
+func (this *PBProcessor) Catalog() []*CatalogEntry {
+	var entries []*CatalogEntry
+	for msgId, msgInfo := range this.msgInfoList {
+		if msgInfo.msgType != nil || msgInfo.msgDesc != nil {
+			entry := newCatalogEntry(msgId, CATALOG_MSG, msgInfo.descriptor())
+			entry.Handler = funcName(msgInfo.msgHandler)
+			if msgInfo.reqHandler != nil {
+				entry.Kind = CATALOG_REQUEST
+				entry.Handler = funcName(msgInfo.reqHandler)
+				entry.RespId = msgInfo.respId
+			}
+			entries = append(entries, entry)
+		}
+
+		for _, versionInfo := range msgInfo.versions {
+			entry := newCatalogEntry(msgId, CATALOG_MSG, versionInfo.descriptor())
+			entry.Handler = funcName(versionInfo.msgHandler)
+			entry.MinVersion = versionInfo.minVersion
+			entries = append(entries, entry)
+		}
+	}
+
+	for respId, respType := range this.respTypeList {
+		if _, ok := this.msgInfoList[respId]; ok {
+			continue
+		}
+		msg := reflect.New(respType.Elem()).Interface().(proto.Message)
+		entries = append(entries, newCatalogEntry(respId, CATALOG_RESPONSE, proto.MessageV2(msg).ProtoReflect().Descriptor()))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].MsgId != entries[j].MsgId {
+			return entries[i].MsgId < entries[j].MsgId
+		}
+		return entries[i].MinVersion < entries[j].MinVersion
+	})
+
+	return entries
+}
+
+func (this *PBProcessor) CatalogJSON() ([]byte, error) {
+	return json.MarshalIndent(this.Catalog(), "", "  ")
+}
+
+func (this *PBProcessor) CatalogMarkdown() string {
+	var buf bytes.Buffer
+	buf.WriteString("| msgId | kind | message | handler |\n")
+	buf.WriteString("| --- | --- | --- | --- |\n")
+
+	entries := this.Catalog()
+	for _, entry := range entries {
+		kind := entry.Kind
+		if entry.RespId != 0 {
+			kind = fmt.Sprintf("%v, resp %v", kind, entry.RespId)
+		}
+		if entry.MinVersion != 0 {
+			kind = fmt.Sprintf("%v, version >= %v", kind, entry.MinVersion)
+		}
+		fmt.Fprintf(&buf, "| %v | %v | [%v](#%v) | `%v` |\n",
+			entry.MsgId, kind, entry.Name, anchor(entry.Name), entry.Handler)
+	}
+
+	written := make(map[string]bool)
+	for _, entry := range entries {
+		if written[entry.Name] {
+			continue
+		}
+		written[entry.Name] = true
+
+		fmt.Fprintf(&buf, "\n### %v\n\n", entry.Name)
+		if len(entry.Fields) == 0 {
+			buf.WriteString("no fields\n")
+			continue
+		}
+		buf.WriteString("| field | number | type |\n")
+		buf.WriteString("| --- | --- | --- |\n")
+		for _, field := range entry.Fields {
+			fieldType := field.Type
+			if field.Repeated {
+				fieldType = "repeated " + fieldType
+			}
+			fmt.Fprintf(&buf, "| %v | %v | %v |\n", field.Name, field.Number, fieldType)
+		}
+	}
+
+	return buf.String()
+}
+
+// the anchor of a markdown heading
+func anchor(name string) string {
+	return strings.ToLower(strings.Replace(name, ".", "", -1))
+}
+
+// registering a msgId twice is a bug, fail at startup instead of
+// overwriting the first handler
+func (this *PBProcessor) checkDuplicate(msgId uint32, name string) {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok || (msgInfo.msgType == nil && msgInfo.msgDesc == nil) {
+		return
+	}
+
+	oldName, _ := describe(msgInfo.descriptor())
+	log.Fatal("msgId: %v registered twice, by %v and %v", msgId, oldName, name)
+}
+
+// registered msgIds, sorted
+func (this *PBProcessor) MsgIds() []uint32 {
+	msgIds := make([]uint32, 0, len(this.msgInfoList))
+	for msgId := range this.msgInfoList {
+		msgIds = append(msgIds, msgId)
+	}
+	sort.Slice(msgIds, func(i, j int) bool { return msgIds[i] < msgIds[j] })
+
+	return msgIds
+}
@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"gameserver/core/processor/pb"
+	"sync"
+	"time"
+)
+
+// what the processor knows about a client, dropped by RemoveClient, or by
+// RouteServerMsg for the clients of a gateway
+type clientState struct {
+	// set by the handshake
+	handshaked   bool
+	version      uint32
+	capabilities uint64
+
+	// set by RouteServerMsg for clients behind a gateway
+	gatewayId  uint64
+	viaGateway bool
+
+	// invalid msgs, see EnableValidation
+	violations int64
+
+	// bad frames, see SetBadFramePolicy
+	strikes     int
+	strikeStart time.Time
+	struckOut   bool
+
+	// the last reliable push handled in order, on the client side, and the
+	// pushes that came before the one sent ahead of them, by prev seq
+	pushSeq     uint64
+	earlyPushes map[uint64]*pb.ReliablePush
+}
+
+type clientStates struct {
+	sync.RWMutex
+	states map[uint64]*clientState
+}
+
+func newClientStates() *clientStates {
+	return &clientStates{
+		states: make(map[uint64]*clientState),
+	}
+}
+
+// a copy of the state
+func (this *clientStates) get(clientId uint64) (clientState, bool) {
+	this.RLock()
+	defer this.RUnlock()
+
+	state, ok := this.states[clientId]
+	if !ok {
+		return clientState{}, false
+	}
+	return *state, true
+}
+
+func (this *clientStates) update(clientId uint64, f func(state *clientState)) {
+	this.Lock()
+	defer this.Unlock()
+
+	state, ok := this.states[clientId]
+	if !ok {
+		state = &clientState{}
+		this.states[clientId] = state
+	}
+	f(state)
+}
+
+func (this *clientStates) remove(clientId uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.states, clientId)
+}
+
+// use the client states of other, so the handshake, validation and bad frame
+// state of a client is the same on every processor its msgs are routed to,
+// the services of a Dispatcher for example. the handshake config of other is
+// used as well if this has none, call it once both are configured
+func (this *PBProcessor) ShareClients(other *PBProcessor) {
+	this.clients = other.clients
+	if this.handshake == nil {
+		this.handshake = other.handshake
+	}
+}
+
+// forget the state of a disconnected client
+func (this *PBProcessor) RemoveClient(clientId uint64) {
+	this.clients.remove(clientId)
+	if this.reliable != nil {
+		this.reliable.logout(clientId)
+	}
+}
@@ -0,0 +1,137 @@
+package processor
+
+import (
+	"fmt"
+	"gameserver/core/processor/pb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+)
+
+// load the descriptors of msgs this binary was not compiled with, they can be
+// registered by RegisterDynamic afterwards
+func (this *PBProcessor) LoadDescriptorSet(fds *descriptorpb.FileDescriptorSet) error {
+	files, err := protodesc.NewFiles(fds)
+	if err != nil {
+		return err
+	}
+
+	this.files = files
+	return nil
+}
+
+// file written by protoc --include_imports --descriptor_set_out
+func (this *PBProcessor) LoadDescriptorSetFile(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, fds); err != nil {
+		return err
+	}
+
+	return this.LoadDescriptorSet(fds)
+}
+
+func (this *PBProcessor) findDescriptor(fullName string) (protoreflect.MessageDescriptor, error) {
+	if this.files == nil {
+		return nil, fmt.Errorf("no descriptor set loaded")
+	}
+
+	desc, err := this.files.FindDescriptorByName(protoreflect.FullName(fullName))
+	if err != nil {
+		return nil, err
+	}
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a message", fullName)
+	}
+
+	return msgDesc, nil
+}
+
+// the handler receives a *dynamicpb.Message, which can be printed, read with
+// protoreflect or marshaled again
+func (this *PBProcessor) RegisterDynamic(msgId uint32, fullName string, msgHandler MessageHandler) error {
+	if msgHandler == nil {
+		return fmt.Errorf("nil handler of msgId: %v", msgId)
+	}
+	msgDesc, err := this.findDescriptor(fullName)
+	if err != nil {
+		return err
+	}
+
+	this.checkDuplicate(msgId, fullName)
+	this.msgInfoList[msgId] = &MessageInfo{
+		msgDesc:    msgDesc,
+		msgHandler: msgHandler,
+	}
+	this.rebuildHandler(msgId)
+	this.loadRules(msgId)
+
+	return nil
+}
+
+// register every loaded msg that has a (core.msg_id) option, nested ones
+// included, return the number of msgs registered
+func (this *PBProcessor) RegisterDynamicAll(msgHandler MessageHandler) (int, error) {
+	if msgHandler == nil {
+		return 0, fmt.Errorf("nil handler")
+	}
+	if this.files == nil {
+		return 0, fmt.Errorf("no descriptor set loaded")
+	}
+
+	var msgDescs []protoreflect.MessageDescriptor
+	this.files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		msgDescs = appendMessages(msgDescs, file.Messages())
+		return true
+	})
+
+	n := 0
+	for _, msgDesc := range msgDescs {
+		opts, ok := msgDesc.Options().(*descriptorpb.MessageOptions)
+		if !ok || opts == nil || !proto.HasExtension(opts, pb.E_MsgId) {
+			continue
+		}
+
+		value, err := proto.GetExtension(opts, pb.E_MsgId)
+		if err != nil {
+			return n, err
+		}
+		msgId := *value.(*uint32)
+		this.checkDuplicate(msgId, string(msgDesc.FullName()))
+		this.msgInfoList[msgId] = &MessageInfo{
+			msgDesc:    msgDesc,
+			msgHandler: msgHandler,
+		}
+		this.rebuildHandler(msgId)
+		this.loadRules(msgId)
+		n++
+	}
+
+	return n, nil
+}
+
+func appendMessages(msgDescs []protoreflect.MessageDescriptor, msgs protoreflect.MessageDescriptors) []protoreflect.MessageDescriptor {
+	for i := 0; i < msgs.Len(); i++ {
+		msgDescs = append(msgDescs, msgs.Get(i))
+		msgDescs = appendMessages(msgDescs, msgs.Get(i).Messages())
+	}
+	return msgDescs
+}
+
+// the descriptors loaded by LoadDescriptorSet, nil if none
+func (this *PBProcessor) Files() *protoregistry.Files {
+	return this.files
+}
+
+func newDynamicMessage(msgDesc protoreflect.MessageDescriptor) proto.Message {
+	return dynamicpb.NewMessage(msgDesc)
+}
@@ -0,0 +1,150 @@
+package processor
+
+import (
+	"fmt"
+	"gameserver/core/log"
+	"gameserver/core/processor/pb"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+	"sort"
+)
+
+// versions the server speaks are [MinVersion, MaxVersion], a newer client is
+// downgraded to MaxVersion and an older one is rejected
+type HandshakeConfig struct {
+	MinVersion   uint32
+	MaxVersion   uint32
+	Capabilities uint64
+
+	// drop the msgs of clients that have not sent HandshakeReq
+	Required bool
+
+	// called after HandshakeResp is sent, a rejected client should be
+	// disconnected by the owner of the connection
+	OnAccept func(clientId uint64, version uint32, capabilities uint64)
+	OnReject func(clientId uint64, version uint32)
+}
+
+func (this *PBProcessor) EnableHandshake(config *HandshakeConfig) {
+	if config.MinVersion > config.MaxVersion {
+		log.Fatal("invalid handshake versions: [%v, %v]", config.MinVersion, config.MaxVersion)
+	}
+
+	this.handshake = config
+}
+
+// the negotiated version and capabilities, ok is false before the handshake
+func (this *PBProcessor) ClientVersion(clientId uint64) (uint32, uint64, bool) {
+	state, ok := this.clients.get(clientId)
+	if !ok || !state.handshaked {
+		return 0, 0, false
+	}
+	return state.version, state.capabilities, true
+}
+
+// the version to route msgId with, false if the msg must be dropped
+func (this *PBProcessor) checkHandshake(clientId uint64, msgId uint32) (uint32, bool) {
+	if this.handshake == nil {
+		return 0, true
+	}
+
+	version, _, ok := this.ClientVersion(clientId)
+	if !ok && this.handshake.Required {
+		log.Warn("msgId: %v before handshake, clientId: %v", msgId, clientId)
+		return 0, false
+	}
+
+	return version, true
+}
+
+// frame is the whole frame with msgId
+func (this *PBProcessor) routeHandshake(clientId uint64, frame []byte) {
+	req := &pb.HandshakeReq{}
+	if err := proto.Unmarshal(frame[utils2.MSG_ID_LEN:], req); err != nil {
+		log.Warn("invalid handshake, clientId: %v, err: %v", clientId, err)
+		this.onBadFrame(clientId, BAD_FRAME_UNMARSHAL, HANDSHAKE_REQ_MSG_ID, frame, false)
+		return
+	}
+
+	config := this.handshake
+	resp := &pb.HandshakeResp{
+		MinVersion: config.MinVersion,
+		MaxVersion: config.MaxVersion,
+	}
+
+	accepted := req.Version >= config.MinVersion
+	if accepted {
+		resp.Version = req.Version
+		if resp.Version > config.MaxVersion {
+			resp.Version = config.MaxVersion
+		}
+		resp.Capabilities = req.Capabilities & config.Capabilities
+		this.clients.update(clientId, func(state *clientState) {
+			state.handshaked = true
+			state.version = resp.Version
+			state.capabilities = resp.Capabilities
+		})
+	} else {
+		resp.Code = ERROR_CODE_UNSUPPORTED_VERSION
+		resp.Message = fmt.Sprintf("version %v is not supported, min version is %v", req.Version, config.MinVersion)
+		log.Info("reject clientId: %v, version: %v", clientId, req.Version)
+	}
+
+	msgData, err := this.Marshal(HANDSHAKE_RESP_MSG_ID, resp)
+	if err != nil {
+		log.Error("marshal handshake error: %v", err)
+		return
+	}
+	this.send(clientId, HANDSHAKE_RESP_MSG_ID, resp, msgData)
+
+	if accepted && config.OnAccept != nil {
+		config.OnAccept(clientId, resp.Version, resp.Capabilities)
+	} else if !accepted && config.OnReject != nil {
+		config.OnReject(clientId, req.Version)
+	}
+}
+
+// handle msgId of clients whose negotiated version is at least minVersion,
+// older clients fall back to the next lower version or to Register. without
+// Register older clients are dropped and Unmarshal of msgId fails
+func (this *PBProcessor) RegisterVersion(msgId uint32, minVersion uint32, msg proto.Message, msgHandler MessageHandler) {
+	checkHandler(msgId, msgHandler != nil)
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		msgInfo = &MessageInfo{}
+		this.msgInfoList[msgId] = msgInfo
+	}
+
+	for _, versionInfo := range msgInfo.versions {
+		if versionInfo.minVersion == minVersion {
+			log.Fatal("msgId: %v version: %v registered twice", msgId, minVersion)
+		}
+	}
+
+	versions := append([]*MessageInfo(nil), msgInfo.versions...)
+	versions = append(versions, &MessageInfo{
+		msgType:    reflect.TypeOf(msg),
+		msgHandler: msgHandler,
+		minVersion: minVersion,
+	})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].minVersion > versions[j].minVersion })
+
+	msgInfo.versions = versions
+	this.rebuildHandler(msgId)
+	this.loadRules(msgId)
+}
+
+// nil if there is no handler for version
+func (this *MessageInfo) forVersion(version uint32) *MessageInfo {
+	for _, versionInfo := range this.versions {
+		if versionInfo.minVersion <= version {
+			return versionInfo
+		}
+	}
+
+	if !this.hasType() {
+		return nil
+	}
+	return this
+}
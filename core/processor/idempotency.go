@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+type idempotentKey struct {
+	clientId uint64
+	msgId    uint32
+	seq      uint32
+}
+
+type idempotentEntry struct {
+	// a reused seq with another payload is a new request
+	hash   uint64
+	reply  []byte
+	done   bool
+	expire time.Time
+}
+
+// the outcome of requests by (clientId, msgId, seq), all methods are no-ops
+// on a nil *idempotency
+type idempotency struct {
+	sync.Mutex
+	window    time.Duration
+	msgIds    map[uint32]bool
+	entries   map[idempotentKey]*idempotentEntry
+	lastSweep time.Time
+}
+
+// a request of msgIds repeated with the same seq and payload within window
+// gets the reply of the first one again instead of running its handler, no
+// msgIds means every request. clients retrying a request must resend the
+// seq of the first try, and the clientId must survive a reconnect for
+// retries after it, a player id behind a gateway for example
+func (this *PBProcessor) EnableIdempotency(window time.Duration, msgIds ...uint32) {
+	if window <= 0 {
+		log.Fatal("invalid idempotency window: %v", window)
+	}
+
+	idempotency := &idempotency{
+		window:    window,
+		msgIds:    make(map[uint32]bool),
+		entries:   make(map[idempotentKey]*idempotentEntry),
+		lastSweep: time.Now(),
+	}
+	for _, msgId := range msgIds {
+		idempotency.msgIds[msgId] = true
+	}
+	this.idempotency = idempotency
+}
+
+func payloadHash(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// run is false for a duplicate, reply is what to send back then, nil while
+// the first request is still running. a request that ended without a reply
+// is forgotten, so its retries run again. hash is passed to finish
+func (this *idempotency) begin(key idempotentKey, payload []byte) ([]byte, uint64, bool) {
+	if this == nil || (len(this.msgIds) > 0 && !this.msgIds[key.msgId]) {
+		return nil, 0, true
+	}
+
+	now := time.Now()
+	hash := payloadHash(payload)
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.sweep(now)
+	if entry, ok := this.entries[key]; ok && entry.hash == hash && now.Before(entry.expire) {
+		if !entry.done {
+			log.Debug("duplicate request still running, clientId: %v, msgId: %v, seq: %v", key.clientId, key.msgId, key.seq)
+			return nil, hash, false
+		}
+		log.Debug("duplicate request, clientId: %v, msgId: %v, seq: %v", key.clientId, key.msgId, key.seq)
+		return entry.reply, hash, false
+	}
+
+	this.entries[key] = &idempotentEntry{
+		hash:   hash,
+		expire: now.Add(this.window),
+	}
+	return nil, hash, true
+}
+
+// reply is nil if the handler replied nothing or panicked. the entry is left
+// alone if a request with the same seq and another payload replaced it
+// meanwhile
+func (this *idempotency) finish(key idempotentKey, hash uint64, reply []byte) {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok || entry.hash != hash {
+		return
+	}
+	if reply == nil {
+		delete(this.entries, key)
+		return
+	}
+	entry.reply = reply
+	entry.done = true
+	entry.expire = time.Now().Add(this.window)
+}
+
+func (this *idempotency) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < this.window {
+		return
+	}
+	this.lastSweep = now
+
+	for key, entry := range this.entries {
+		if !now.Before(entry.expire) {
+			delete(this.entries, key)
+		}
+	}
+}
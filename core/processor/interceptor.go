@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"fmt"
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"runtime"
+	"time"
+)
+
+// the msg being handled, passed along the interceptor chain
+type Call struct {
+	ClientId uint64
+	MsgId    uint32
+
+	// set for requests registered by RegisterRequest
+	Request bool
+	Seq     uint32
+
+	processor *PBProcessor
+	replied   bool
+	// the frame replied to the request, nil if none
+	reply []byte
+}
+
+// reply err to the request as ErrorResp with its seq, a no-op for other msgs
+// and for a request already replied
+func (this *Call) ReplyError(err error) {
+	this.replyResp(nil, err)
+}
+
+func (this *Call) replyResp(resp proto.Message, err error) {
+	if !this.Request || this.replied {
+		return
+	}
+	this.replied = true
+	this.reply = this.processor.reply(this.ClientId, this.MsgId, this.Seq, resp, err)
+}
+
+type CallHandler func(call *Call, msg proto.Message)
+
+// wraps a handler, call next to continue the chain or skip it to stop
+type Interceptor func(call *Call, msg proto.Message, next CallHandler)
+
+// interceptors[0] is the outermost
+func chainInterceptors(handler CallHandler, interceptors []Interceptor) CallHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := handler
+		handler = func(call *Call, msg proto.Message) {
+			interceptor(call, msg, next)
+		}
+	}
+
+	return handler
+}
+
+func callHandler(handler MessageHandler) CallHandler {
+	return func(call *Call, msg proto.Message) {
+		handler(call.ClientId, msg)
+	}
+}
+
+// global interceptors run before the per msgId ones
+func (this *PBProcessor) Use(interceptors ...Interceptor) {
+	this.interceptors = append(this.interceptors, interceptors...)
+	for msgId := range this.msgInfoList {
+		this.rebuildHandler(msgId)
+	}
+}
+
+func (this *PBProcessor) UseFor(msgId uint32, interceptors ...Interceptor) {
+	this.msgInterceptors[msgId] = append(this.msgInterceptors[msgId], interceptors...)
+	this.rebuildHandler(msgId)
+}
+
+func (this *PBProcessor) wrapHandler(msgId uint32, handler CallHandler) CallHandler {
+	handler = chainInterceptors(handler, this.msgInterceptors[msgId])
+	return chainInterceptors(handler, this.interceptors)
+}
+
+func (this *PBProcessor) rebuildHandler(msgId uint32) {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		return
+	}
+
+	if msgInfo.reqHandler != nil {
+		msgInfo.handler = this.wrapHandler(msgId, replyHandler(msgInfo.reqHandler))
+	} else if msgInfo.msgHandler != nil {
+		msgInfo.handler = this.wrapHandler(msgId, callHandler(msgInfo.msgHandler))
+	}
+	for _, versionInfo := range msgInfo.versions {
+		versionInfo.handler = this.wrapHandler(msgId, callHandler(versionInfo.msgHandler))
+	}
+}
+
+//********************************************************
+// built-in interceptors
+//********************************************************
+
+// recover a panic in the handler, onPanic can reply an error to the client
+// with call.ReplyError, a request it does not reply is replied
+// ERROR_CODE_INTERNAL
+func RecoverInterceptor(onPanic func(call *Call, err error)) Interceptor {
+	return func(call *Call, msg proto.Message, next CallHandler) {
+		defer func() {
+			if r := recover(); r != nil {
+				buf := make([]byte, 4096)
+				l := runtime.Stack(buf, false)
+				log.Error("handler panic, clientId: %v, msgId: %v, err: %v: %s", call.ClientId, call.MsgId, r, buf[:l])
+				if onPanic != nil {
+					onPanic(call, fmt.Errorf("%v", r))
+				}
+				call.ReplyError(NewCodeError(ERROR_CODE_INTERNAL, "internal error"))
+			}
+		}()
+
+		next(call, msg)
+	}
+}
+
+func SlowLogInterceptor(threshold time.Duration) Interceptor {
+	return func(call *Call, msg proto.Message, next CallHandler) {
+		start := time.Now()
+		next(call, msg)
+		if cost := time.Since(start); cost >= threshold {
+			log.Warn("slow handler, clientId: %v, msgId: %v, cost: %v", call.ClientId, call.MsgId, cost)
+		}
+	}
+}
+
+// record is called after every handler, even if it panics
+func MetricsInterceptor(record func(msgId uint32, cost time.Duration)) Interceptor {
+	return func(call *Call, msg proto.Message, next CallHandler) {
+		start := time.Now()
+		defer func() {
+			record(call.MsgId, time.Since(start))
+		}()
+
+		next(call, msg)
+	}
+}
+
+// drop msgs from clients that are not authenticated, except the msgIds in
+// allow such as login
+func AuthInterceptor(isAuthed func(clientId uint64) bool, onReject func(clientId uint64, msgId uint32), allow ...uint32) Interceptor {
+	allowed := make(map[uint32]struct{}, len(allow))
+	for _, msgId := range allow {
+		allowed[msgId] = struct{}{}
+	}
+
+	return func(call *Call, msg proto.Message, next CallHandler) {
+		if _, ok := allowed[call.MsgId]; ok || isAuthed(call.ClientId) {
+			next(call, msg)
+			return
+		}
+
+		log.Debug("unauthenticated msg, clientId: %v, msgId: %v", call.ClientId, call.MsgId)
+		if onReject != nil {
+			onReject(call.ClientId, call.MsgId)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	commonErrors "gameserver/common/errors"
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+	"sort"
+)
+
+// {"id": 1001, "name": "pb.LoginReq", "msg": {...}}
+// either id or name is enough to route an incoming envelope
+type JSONEnvelope struct {
+	Id   uint32          `json:"id,omitempty"`
+	Name string          `json:"name,omitempty"`
+	Msg  json.RawMessage `json:"msg"`
+}
+
+type jsonMessageInfo struct {
+	msgId      uint32
+	name       string
+	msgType    reflect.Type
+	msgHandler MessageHandler
+}
+
+type JSONProcessor struct {
+	msgInfoList  map[uint32]*jsonMessageInfo
+	msgNameList  map[string]*jsonMessageInfo
+	marshalOpt   protojson.MarshalOptions
+	unmarshalOpt protojson.UnmarshalOptions
+}
+
+func NewJSONProcessor() *JSONProcessor {
+	return &JSONProcessor{
+		msgInfoList:  make(map[uint32]*jsonMessageInfo),
+		msgNameList:  make(map[string]*jsonMessageInfo),
+		unmarshalOpt: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}
+}
+
+// options for msgs that are protobuf types
+func (this *JSONProcessor) SetProtoJSONOptions(marshalOpt protojson.MarshalOptions, unmarshalOpt protojson.UnmarshalOptions) {
+	this.marshalOpt = marshalOpt
+	this.unmarshalOpt = unmarshalOpt
+}
+
+// full name for protobuf types, go type name for the others
+func messageName(msg proto.Message) string {
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		return string(m.ProtoReflect().Descriptor().FullName())
+	}
+	return reflect.TypeOf(msg).Elem().String()
+}
+
+// the msg can also be routed by its name
+func (this *JSONProcessor) Register(msgId uint32, msg proto.Message, msgHandler MessageHandler) {
+	checkHandler(msgId, msgHandler != nil)
+	if old, ok := this.msgInfoList[msgId]; ok {
+		log.Fatal("msgId: %v registered twice, by %v and %v", msgId, old.name, messageName(msg))
+	}
+	name := messageName(msg)
+	if old, ok := this.msgNameList[name]; ok {
+		log.Fatal("msg name: %v registered twice, by %v and %v", name, old.msgType, reflect.TypeOf(msg))
+	}
+	info := &jsonMessageInfo{
+		msgId:      msgId,
+		name:       name,
+		msgType:    reflect.TypeOf(msg),
+		msgHandler: msgHandler,
+	}
+	this.msgInfoList[msgId] = info
+	this.msgNameList[info.name] = info
+}
+
+// for clients that only know msg names, name defaults to the msg full name
+func (this *JSONProcessor) RegisterName(name string, msg proto.Message, msgHandler MessageHandler) {
+	if name == "" {
+		name = messageName(msg)
+	}
+	if msgHandler == nil {
+		log.Fatal("nil handler of msg name: %v", name)
+	}
+	if old, ok := this.msgNameList[name]; ok {
+		log.Fatal("msg name: %v registered twice, by %v and %v", name, old.msgType, reflect.TypeOf(msg))
+	}
+	this.msgNameList[name] = &jsonMessageInfo{
+		name:       name,
+		msgType:    reflect.TypeOf(msg),
+		msgHandler: msgHandler,
+	}
+}
+
+func (this *JSONProcessor) findInfo(envelope *JSONEnvelope) (*jsonMessageInfo, bool) {
+	if envelope.Id != 0 {
+		info, ok := this.msgInfoList[envelope.Id]
+		return info, ok
+	}
+	info, ok := this.msgNameList[envelope.Name]
+	return info, ok
+}
+
+func (this *JSONProcessor) Route(clientId uint64, msgData []byte) {
+	var envelope JSONEnvelope
+	if err := json.Unmarshal(msgData, &envelope); err != nil {
+		log.Warn("invalid json envelope: %v", err)
+		return
+	}
+
+	info, ok := this.findInfo(&envelope)
+	if !ok {
+		log.Warn("msg not found, id: %v, name: %v", envelope.Id, envelope.Name)
+		return
+	}
+
+	msg, err := this.unmarshal(info, envelope.Msg)
+	if err != nil {
+		log.Warn("unmarshall error, id: %v, name: %v, err: %v", envelope.Id, envelope.Name, err)
+		return
+	}
+
+	info.msgHandler(clientId, msg)
+}
+
+func (this *JSONProcessor) unmarshal(info *jsonMessageInfo, msgData []byte) (proto.Message, error) {
+	msg := reflect.New(info.msgType.Elem()).Interface().(proto.Message)
+	if len(msgData) == 0 {
+		return msg, nil
+	}
+
+	var err error
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		err = this.unmarshalOpt.Unmarshal(msgData, m)
+	} else {
+		err = json.Unmarshal(msgData, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// msgData is the "msg" field of the envelope
+func (this *JSONProcessor) Unmarshal(msgId uint32, msgData []byte) (proto.Message, error) {
+	info, ok := this.msgInfoList[msgId]
+	if !ok {
+		log.Warn("msgId not found: %v", msgId)
+		return nil, commonErrors.ERROR_NOT_FOUND
+	}
+
+	return this.unmarshal(info, msgData)
+}
+
+func (this *JSONProcessor) marshal(envelope *JSONEnvelope, msg proto.Message) ([]byte, error) {
+	var err error
+	if m, ok := msg.(protoreflect.ProtoMessage); ok {
+		envelope.Msg, err = this.marshalOpt.Marshal(m)
+	} else {
+		envelope.Msg, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope)
+}
+
+// envelope with id and name
+func (this *JSONProcessor) Marshal(msgId uint32, msg proto.Message) ([]byte, error) {
+	info, ok := this.msgInfoList[msgId]
+	if !ok {
+		return nil, fmt.Errorf("msgId not registered: %v", msgId)
+	}
+
+	return this.marshal(&JSONEnvelope{Id: msgId, Name: info.name}, msg)
+}
+
+// envelope with name only
+func (this *JSONProcessor) MarshalName(name string, msg proto.Message) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("empty msg name")
+	}
+
+	return this.marshal(&JSONEnvelope{Name: name}, msg)
+}
+
+// msgIds registered by Register, sorted
+func (this *JSONProcessor) MsgIds() []uint32 {
+	msgIds := make([]uint32, 0, len(this.msgInfoList))
+	for msgId := range this.msgInfoList {
+		msgIds = append(msgIds, msgId)
+	}
+	sort.Slice(msgIds, func(i, j int) bool { return msgIds[i] < msgIds[j] })
+
+	return msgIds
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"os"
+	"testing"
+)
+
+func init() {
+	log.InitLog(os.TempDir(), "error", false, 0)
+}
+
+func TestJSONProcessor(t *testing.T) {
+	p := NewJSONProcessor()
+
+	var got *descriptorpb.FileOptions
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		got = msg.(*descriptorpb.FileOptions)
+	})
+
+	msgData, err := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String("game")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Route(1, msgData)
+	if got.GetJavaPackage() != "game" {
+		t.Fatalf("routed by id: %v", got)
+	}
+
+	got = nil
+	p.Route(1, []byte(`{"name": "google.protobuf.FileOptions", "msg": {"javaPackage": "h5"}}`))
+	if got.GetJavaPackage() != "h5" {
+		t.Fatalf("routed by name: %v", got)
+	}
+}
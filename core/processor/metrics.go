@@ -0,0 +1,280 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"gameserver/core/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// upper bounds of the handler latency histogram, the last bucket is unbounded
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type MsgMetrics struct {
+	MsgId           uint32
+	InCount         int64
+	InBytes         int64
+	OutCount        int64
+	OutBytes        int64
+	UnmarshalErrors int64
+	HandleCount     int64
+	LatencySum      time.Duration
+	LatencyMax      time.Duration
+	Buckets         []int64 // len(LatencyBuckets) + 1
+}
+
+func (this *MsgMetrics) LatencyAvg() time.Duration {
+	if this.HandleCount == 0 {
+		return 0
+	}
+	return this.LatencySum / time.Duration(this.HandleCount)
+}
+
+// upper bound of the bucket holding the p-th latency, LatencyMax for the
+// unbounded bucket
+func (this *MsgMetrics) Percentile(p float64) time.Duration {
+	target := int64(float64(this.HandleCount) * p)
+	var n int64
+	for i, count := range this.Buckets {
+		n += count
+		if n > target || (n == this.HandleCount && n > 0) {
+			if i < len(LatencyBuckets) {
+				return LatencyBuckets[i]
+			}
+			return this.LatencyMax
+		}
+	}
+	return 0
+}
+
+// goroutine safe, all methods are no-ops on a nil *Metrics
+type Metrics struct {
+	sync.Mutex
+	msgs  map[uint32]*MsgMetrics
+	start time.Time
+	stop  chan struct{}
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		msgs:  make(map[uint32]*MsgMetrics),
+		start: time.Now(),
+	}
+}
+
+func (this *Metrics) get(msgId uint32) *MsgMetrics {
+	m, ok := this.msgs[msgId]
+	if !ok {
+		m = &MsgMetrics{
+			MsgId:   msgId,
+			Buckets: make([]int64, len(LatencyBuckets)+1),
+		}
+		this.msgs[msgId] = m
+	}
+	return m
+}
+
+func (this *Metrics) addIn(msgId uint32, size int) {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	m := this.get(msgId)
+	m.InCount++
+	m.InBytes += int64(size)
+}
+
+func (this *Metrics) addOut(msgId uint32, size int) {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	m := this.get(msgId)
+	m.OutCount++
+	m.OutBytes += int64(size)
+}
+
+func (this *Metrics) addUnmarshalError(msgId uint32) {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+	this.get(msgId).UnmarshalErrors++
+}
+
+func (this *Metrics) addLatency(msgId uint32, d time.Duration) {
+	if this == nil {
+		return
+	}
+
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+
+	this.Lock()
+	defer this.Unlock()
+	m := this.get(msgId)
+	m.HandleCount++
+	m.LatencySum += d
+	if d > m.LatencyMax {
+		m.LatencyMax = d
+	}
+	m.Buckets[i]++
+}
+
+// copy of the metrics since the last reset, sorted by msgId
+func (this *Metrics) Snapshot() []*MsgMetrics {
+	if this == nil {
+		return nil
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	result := make([]*MsgMetrics, 0, len(this.msgs))
+	for _, m := range this.msgs {
+		c := *m
+		c.Buckets = append([]int64(nil), m.Buckets...)
+		result = append(result, &c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].MsgId < result[j].MsgId })
+
+	return result
+}
+
+// start a new profiling window, return how long the last one lasted
+func (this *Metrics) Reset() time.Duration {
+	if this == nil {
+		return 0
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	d := time.Since(this.start)
+	this.msgs = make(map[uint32]*MsgMetrics)
+	this.start = time.Now()
+
+	return d
+}
+
+// the topN msgs by total handler time and by inbound bytes
+func (this *Metrics) Summary(topN int) string {
+	snapshot := this.Snapshot()
+
+	var buf bytes.Buffer
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].LatencySum > snapshot[j].LatencySum })
+	buf.WriteString("top handler time:")
+	for i := 0; i < topN && i < len(snapshot); i++ {
+		m := snapshot[i]
+		fmt.Fprintf(&buf, "\n\tmsgId: %v, count: %v, total: %v, avg: %v, p99: %v, max: %v",
+			m.MsgId, m.HandleCount, m.LatencySum, m.LatencyAvg(), m.Percentile(0.99), m.LatencyMax)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].InBytes > snapshot[j].InBytes })
+	buf.WriteString("\ntop inbound bytes:")
+	for i := 0; i < topN && i < len(snapshot); i++ {
+		m := snapshot[i]
+		fmt.Fprintf(&buf, "\n\tmsgId: %v, count: %v, bytes: %v, out count: %v, out bytes: %v, unmarshal errors: %v",
+			m.MsgId, m.InCount, m.InBytes, m.OutCount, m.OutBytes, m.UnmarshalErrors)
+	}
+
+	return buf.String()
+}
+
+// log Summary every interval until StopReport
+func (this *Metrics) StartReport(interval time.Duration, topN int) {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	if this.stop != nil {
+		this.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	this.stop = stop
+	this.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				log.Info("msg metrics:\n%s", this.Summary(topN))
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (this *Metrics) StopReport() {
+	if this == nil {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+//********************************************************
+// processor
+//********************************************************
+
+// start recording, the returned metrics stay valid until DisableMetrics.
+// metrics can be switched on and off while msgs are routed
+func (this *PBProcessor) EnableMetrics() *Metrics {
+	this.metricsLock.Lock()
+	defer this.metricsLock.Unlock()
+
+	metrics := this.Metrics()
+	if metrics == nil {
+		metrics = NewMetrics()
+		this.metrics.Store(metrics)
+	}
+	return metrics
+}
+
+// msgs being routed may still be recorded into the old metrics
+func (this *PBProcessor) DisableMetrics() {
+	this.metricsLock.Lock()
+	defer this.metricsLock.Unlock()
+
+	this.Metrics().StopReport()
+	this.metrics.Store((*Metrics)(nil))
+}
+
+// nil if metrics are disabled, load it once per use since it may change
+func (this *PBProcessor) Metrics() *Metrics {
+	metrics, _ := this.metrics.Load().(*Metrics)
+	return metrics
+}
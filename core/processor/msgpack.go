@@ -0,0 +1,581 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"math"
+)
+
+// a protobuf msg in MessagePack is a map from field name to value, decoding
+// also takes the json name or the field number as key and skips unknown keys
+
+var errMsgPackShort = errors.New("msgpack: unexpected end of data")
+
+//********************************************************
+// encode
+//********************************************************
+
+type msgPackEncoder struct {
+	buf []byte
+}
+
+func (this *msgPackEncoder) writeByte(b byte) {
+	this.buf = append(this.buf, b)
+}
+
+func (this *msgPackEncoder) writeUint16(code byte, v uint16) {
+	this.buf = append(this.buf, code, 0, 0)
+	binary.BigEndian.PutUint16(this.buf[len(this.buf)-2:], v)
+}
+
+func (this *msgPackEncoder) writeUint32(code byte, v uint32) {
+	this.buf = append(this.buf, code, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(this.buf[len(this.buf)-4:], v)
+}
+
+func (this *msgPackEncoder) writeUint64(code byte, v uint64) {
+	this.buf = append(this.buf, code, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(this.buf[len(this.buf)-8:], v)
+}
+
+func (this *msgPackEncoder) writeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		this.writeByte(byte(v))
+	case v <= math.MaxUint8:
+		this.buf = append(this.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		this.writeUint16(0xcd, uint16(v))
+	case v <= math.MaxUint32:
+		this.writeUint32(0xce, uint32(v))
+	default:
+		this.writeUint64(0xcf, v)
+	}
+}
+
+func (this *msgPackEncoder) writeInt(v int64) {
+	switch {
+	case v >= 0:
+		this.writeUint(uint64(v))
+	case v >= -32:
+		this.writeByte(byte(v))
+	case v >= math.MinInt8:
+		this.buf = append(this.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		this.writeUint16(0xd1, uint16(v))
+	case v >= math.MinInt32:
+		this.writeUint32(0xd2, uint32(v))
+	default:
+		this.writeUint64(0xd3, uint64(v))
+	}
+}
+
+func (this *msgPackEncoder) writeString(s string) {
+	n := len(s)
+	switch {
+	case n <= 31:
+		this.writeByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		this.buf = append(this.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		this.writeUint16(0xda, uint16(n))
+	default:
+		this.writeUint32(0xdb, uint32(n))
+	}
+	this.buf = append(this.buf, s...)
+}
+
+func (this *msgPackEncoder) writeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		this.buf = append(this.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		this.writeUint16(0xc5, uint16(n))
+	default:
+		this.writeUint32(0xc6, uint32(n))
+	}
+	this.buf = append(this.buf, b...)
+}
+
+func (this *msgPackEncoder) writeArrayLen(n int) {
+	switch {
+	case n <= 15:
+		this.writeByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		this.writeUint16(0xdc, uint16(n))
+	default:
+		this.writeUint32(0xdd, uint32(n))
+	}
+}
+
+func (this *msgPackEncoder) writeMapLen(n int) {
+	switch {
+	case n <= 15:
+		this.writeByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		this.writeUint16(0xde, uint16(n))
+	default:
+		this.writeUint32(0xdf, uint32(n))
+	}
+}
+
+func (this *msgPackEncoder) writeMessage(msg protoreflect.Message) {
+	n := 0
+	msg.Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+		n++
+		return true
+	})
+
+	this.writeMapLen(n)
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		this.writeString(string(fd.Name()))
+		this.writeField(fd, v)
+		return true
+	})
+}
+
+func (this *msgPackEncoder) writeField(fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		this.writeArrayLen(list.Len())
+		for i := 0; i < list.Len(); i++ {
+			this.writeValue(fd, list.Get(i))
+		}
+	case fd.IsMap():
+		m := v.Map()
+		this.writeMapLen(m.Len())
+		m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			this.writeValue(fd.MapKey(), k.Value())
+			this.writeValue(fd.MapValue(), v)
+			return true
+		})
+	default:
+		this.writeValue(fd, v)
+	}
+}
+
+func (this *msgPackEncoder) writeValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if v.Bool() {
+			this.writeByte(0xc3)
+		} else {
+			this.writeByte(0xc2)
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		this.writeInt(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		this.writeUint(v.Uint())
+	case protoreflect.EnumKind:
+		this.writeInt(int64(v.Enum()))
+	case protoreflect.FloatKind:
+		this.writeUint32(0xca, math.Float32bits(float32(v.Float())))
+	case protoreflect.DoubleKind:
+		this.writeUint64(0xcb, math.Float64bits(v.Float()))
+	case protoreflect.StringKind:
+		this.writeString(v.String())
+	case protoreflect.BytesKind:
+		this.writeBytes(v.Bytes())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		this.writeMessage(v.Message())
+	}
+}
+
+func marshalMsgPack(msg protoreflect.Message) []byte {
+	encoder := &msgPackEncoder{}
+	encoder.writeMessage(msg)
+	return encoder.buf
+}
+
+//********************************************************
+// decode
+//********************************************************
+
+type msgPackDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (this *msgPackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(this.buf)-this.pos < n {
+		return nil, errMsgPackShort
+	}
+	b := this.buf[this.pos : this.pos+n]
+	this.pos += n
+	return b, nil
+}
+
+func (this *msgPackDecoder) readCode() (byte, error) {
+	b, err := this.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (this *msgPackDecoder) peekCode() (byte, error) {
+	if this.pos >= len(this.buf) {
+		return 0, errMsgPackShort
+	}
+	return this.buf[this.pos], nil
+}
+
+// n bytes big endian
+func (this *msgPackDecoder) readN(n int) (uint64, error) {
+	b, err := this.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (this *msgPackDecoder) readLen(code byte, fix byte, fixMask byte, code8 byte, code16 byte, code32 byte) (int, bool, error) {
+	var v uint64
+	var err error
+	switch {
+	case fixMask != 0 && code&^fixMask == fix:
+		return int(code & fixMask), true, nil
+	case code8 != 0 && code == code8:
+		v, err = this.readN(1)
+	case code == code16:
+		v, err = this.readN(2)
+	case code == code32:
+		v, err = this.readN(4)
+	default:
+		return 0, false, nil
+	}
+	return int(v), true, err
+}
+
+func (this *msgPackDecoder) readMapLen() (int, error) {
+	code, err := this.readCode()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := this.readLen(code, 0x80, 0x0f, 0, 0xde, 0xdf)
+	if !ok {
+		return 0, fmt.Errorf("msgpack: 0x%x is not a map", code)
+	}
+	return n, err
+}
+
+func (this *msgPackDecoder) readArrayLen() (int, error) {
+	code, err := this.readCode()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := this.readLen(code, 0x90, 0x0f, 0, 0xdc, 0xdd)
+	if !ok {
+		return 0, fmt.Errorf("msgpack: 0x%x is not an array", code)
+	}
+	return n, err
+}
+
+// str or bin
+func (this *msgPackDecoder) readRaw() ([]byte, error) {
+	code, err := this.readCode()
+	if err != nil {
+		return nil, err
+	}
+	n, ok, err := this.readLen(code, 0xa0, 0x1f, 0xd9, 0xda, 0xdb)
+	if !ok {
+		n, ok, err = this.readLen(code, 0, 0, 0xc4, 0xc5, 0xc6)
+	}
+	if !ok {
+		return nil, fmt.Errorf("msgpack: 0x%x is not a string", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return this.next(n)
+}
+
+// any number as int64, uint64 or float64, kind is 'i', 'u' or 'f'
+func (this *msgPackDecoder) readNumber() (int64, uint64, float64, byte, error) {
+	code, err := this.readCode()
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), uint64(code), float64(code), 'u', nil
+	case code >= 0xe0:
+		return int64(int8(code)), 0, float64(int8(code)), 'i', nil
+	case code == 0xc2 || code == 0xc3:
+		v := uint64(code - 0xc2)
+		return int64(v), v, float64(v), 'u', nil
+	}
+
+	var v uint64
+	switch code {
+	case 0xcc, 0xd0:
+		v, err = this.readN(1)
+	case 0xcd, 0xd1:
+		v, err = this.readN(2)
+	case 0xce, 0xd2, 0xca:
+		v, err = this.readN(4)
+	case 0xcf, 0xd3, 0xcb:
+		v, err = this.readN(8)
+	default:
+		return 0, 0, 0, 0, fmt.Errorf("msgpack: 0x%x is not a number", code)
+	}
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	switch code {
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return int64(v), v, float64(v), 'u', nil
+	case 0xd0:
+		i := int64(int8(v))
+		return i, uint64(i), float64(i), 'i', nil
+	case 0xd1:
+		i := int64(int16(v))
+		return i, uint64(i), float64(i), 'i', nil
+	case 0xd2:
+		i := int64(int32(v))
+		return i, uint64(i), float64(i), 'i', nil
+	case 0xd3:
+		i := int64(v)
+		return i, uint64(i), float64(i), 'i', nil
+	case 0xca:
+		f := float64(math.Float32frombits(uint32(v)))
+		return int64(f), uint64(f), f, 'f', nil
+	default:
+		f := math.Float64frombits(v)
+		return int64(f), uint64(f), f, 'f', nil
+	}
+}
+
+// skip one value of any type
+func (this *msgPackDecoder) skip() error {
+	code, err := this.peekCode()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case code <= 0x7f || code >= 0xe0 || code == 0xc0 || code == 0xc2 || code == 0xc3:
+		this.pos++
+		return nil
+	case code&0xf0 == 0x80 || code == 0xde || code == 0xdf:
+		n, err := this.readMapLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2*n; i++ {
+			if err := this.skip(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case code&0xf0 == 0x90 || code == 0xdc || code == 0xdd:
+		n, err := this.readArrayLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := this.skip(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case code&0xe0 == 0xa0 || (code >= 0xc4 && code <= 0xc6) || (code >= 0xd9 && code <= 0xdb):
+		_, err := this.readRaw()
+		return err
+	case code >= 0xca && code <= 0xd3:
+		_, _, _, _, err := this.readNumber()
+		return err
+	}
+
+	// ext types
+	var n int
+	switch code {
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		n = 1 << (code - 0xd4)
+	case 0xc7, 0xc8, 0xc9:
+		size := 1 << (code - 0xc7)
+		this.pos++
+		v, err := this.readN(size)
+		if err != nil {
+			return err
+		}
+		_, err = this.next(int(v) + 1)
+		return err
+	default:
+		return fmt.Errorf("msgpack: invalid code 0x%x", code)
+	}
+	this.pos++
+	_, err = this.next(n + 1)
+	return err
+}
+
+func (this *msgPackDecoder) isNil() bool {
+	if this.pos < len(this.buf) && this.buf[this.pos] == 0xc0 {
+		this.pos++
+		return true
+	}
+	return false
+}
+
+func (this *msgPackDecoder) readMessage(msg protoreflect.Message) error {
+	n, err := this.readMapLen()
+	if err != nil {
+		return err
+	}
+
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < n; i++ {
+		var fd protoreflect.FieldDescriptor
+		code, err := this.peekCode()
+		if err != nil {
+			return err
+		}
+		if code&0xe0 == 0xa0 || (code >= 0xd9 && code <= 0xdb) {
+			key, err := this.readRaw()
+			if err != nil {
+				return err
+			}
+			fd = fields.ByName(protoreflect.Name(key))
+			if fd == nil {
+				fd = fields.ByJSONName(string(key))
+			}
+		} else {
+			_, number, _, _, err := this.readNumber()
+			if err != nil {
+				return err
+			}
+			fd = fields.ByNumber(protoreflect.FieldNumber(number))
+		}
+
+		if fd == nil {
+			if err := this.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if this.isNil() {
+			continue
+		}
+		if err := this.readField(msg, fd); err != nil {
+			return fmt.Errorf("%v: %v", fd.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (this *msgPackDecoder) readField(msg protoreflect.Message, fd protoreflect.FieldDescriptor) error {
+	switch {
+	case fd.IsList():
+		n, err := this.readArrayLen()
+		if err != nil {
+			return err
+		}
+		list := msg.Mutable(fd).List()
+		for i := 0; i < n; i++ {
+			var v protoreflect.Value
+			if fd.Message() != nil {
+				v = list.NewElement()
+				err = this.readMessage(v.Message())
+			} else {
+				v, err = this.readValue(fd)
+			}
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	case fd.IsMap():
+		n, err := this.readMapLen()
+		if err != nil {
+			return err
+		}
+		m := msg.Mutable(fd).Map()
+		for i := 0; i < n; i++ {
+			k, err := this.readValue(fd.MapKey())
+			if err != nil {
+				return err
+			}
+			var v protoreflect.Value
+			if fd.MapValue().Message() != nil {
+				v = m.NewValue()
+				err = this.readMessage(v.Message())
+			} else {
+				v, err = this.readValue(fd.MapValue())
+			}
+			if err != nil {
+				return err
+			}
+			m.Set(k.MapKey(), v)
+		}
+		return nil
+	case fd.Message() != nil:
+		return this.readMessage(msg.Mutable(fd).Message())
+	}
+
+	v, err := this.readValue(fd)
+	if err != nil {
+		return err
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+func (this *msgPackDecoder) readValue(fd protoreflect.FieldDescriptor) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		b, err := this.readRaw()
+		return protoreflect.ValueOfString(string(b)), err
+	case protoreflect.BytesKind:
+		b, err := this.readRaw()
+		return protoreflect.ValueOfBytes(append([]byte(nil), b...)), err
+	}
+
+	i, u, f, _, err := this.readNumber()
+	if err != nil {
+		return protoreflect.Value{}, err
+	}
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(u != 0), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(int32(i)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.ValueOfInt64(i), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(uint32(u)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(u), nil
+	case protoreflect.EnumKind:
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), nil
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(float32(f)), nil
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(f), nil
+	}
+
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %v", fd.Kind())
+}
+
+func unmarshalMsgPack(data []byte, msg protoreflect.Message) error {
+	decoder := &msgPackDecoder{buf: data}
+	if err := decoder.readMessage(msg); err != nil {
+		return err
+	}
+	if decoder.pos != len(data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
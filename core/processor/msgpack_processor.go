@@ -0,0 +1,104 @@
+package processor
+
+import (
+	"fmt"
+	"gameserver/common/errors"
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+	"sort"
+)
+
+type msgPackMessageInfo struct {
+	msgType    reflect.Type
+	msgHandler MessageHandler
+}
+
+// frames are msgId + MessagePack, for engines that do not speak protobuf,
+// msgs are still declared in .proto. it only routes msgs to their handlers,
+// see NewProcessor
+type MsgPackProcessor struct {
+	msgInfoList  map[uint32]*msgPackMessageInfo
+	littleEndian bool
+}
+
+func NewMsgPackProcessor() *MsgPackProcessor {
+	return &MsgPackProcessor{
+		msgInfoList:  make(map[uint32]*msgPackMessageInfo),
+		littleEndian: true,
+	}
+}
+
+func (this *MsgPackProcessor) SetByteOrder(littleEndian bool) {
+	this.littleEndian = littleEndian
+}
+
+func (this *MsgPackProcessor) Register(msgId uint32, msg proto.Message, msgHandler MessageHandler) {
+	checkHandler(msgId, msgHandler != nil)
+	if old, ok := this.msgInfoList[msgId]; ok {
+		log.Fatal("msgId: %v registered twice, by %v and %v", msgId, old.msgType, reflect.TypeOf(msg))
+	}
+
+	this.msgInfoList[msgId] = &msgPackMessageInfo{
+		msgType:    reflect.TypeOf(msg),
+		msgHandler: msgHandler,
+	}
+}
+
+func (this *MsgPackProcessor) Route(clientId uint64, msgData []byte) {
+	if len(msgData) < utils2.MSG_ID_LEN {
+		log.Warn("msg too short, clientId: %v", clientId)
+		return
+	}
+	msgId := utils.ByteToUint32(msgData, this.littleEndian)
+
+	msg, err := this.Unmarshal(msgId, msgData[utils2.MSG_ID_LEN:])
+	if err != nil {
+		return
+	}
+
+	this.msgInfoList[msgId].msgHandler(clientId, msg)
+}
+
+func (this *MsgPackProcessor) Unmarshal(msgId uint32, msgData []byte) (proto.Message, error) {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		log.Warn("msgId not found: %v", msgId)
+		return nil, errors.ERROR_NOT_FOUND
+	}
+
+	msg := reflect.New(msgInfo.msgType.Elem()).Interface().(proto.Message)
+	if err := unmarshalMsgPack(msgData, proto.MessageV2(msg).ProtoReflect()); err != nil {
+		log.Warn("unmarshall error, msgId: %v, err: %v", msgId, err)
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// add head: msgId
+func (this *MsgPackProcessor) Marshal(msgId uint32, msg proto.Message) ([]byte, error) {
+	if _, ok := this.msgInfoList[msgId]; !ok {
+		return nil, fmt.Errorf("msgId not registered: %v", msgId)
+	}
+
+	head := make([]byte, utils2.MSG_ID_LEN)
+	utils.PutUint32ToByte(head, msgId, this.littleEndian)
+	encoder := &msgPackEncoder{buf: head}
+	encoder.writeMessage(proto.MessageV2(msg).ProtoReflect())
+
+	return encoder.buf, nil
+}
+
+// registered msgIds, sorted
+func (this *MsgPackProcessor) MsgIds() []uint32 {
+	msgIds := make([]uint32, 0, len(this.msgInfoList))
+	for msgId := range this.msgInfoList {
+		msgIds = append(msgIds, msgId)
+	}
+	sort.Slice(msgIds, func(i, j int) bool { return msgIds[i] < msgIds[j] })
+
+	return msgIds
+}
@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"testing"
+)
+
+func testFileDescriptor() *descriptorpb.FileDescriptorProto {
+	return protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto)
+}
+
+func TestMsgPackProcessor(t *testing.T) {
+	p := NewProcessor(CODEC_MSGPACK)
+	p.Register(1, &descriptorpb.FileDescriptorProto{}, handleFileOptions)
+
+	msg := testFileDescriptor()
+	msg.Options = &descriptorpb.FileOptions{CcEnableArenas: proto.Bool(true), OptimizeFor: descriptorpb.FileOptions_LITE_RUNTIME.Enum()}
+	msg.MessageType[0].Field[0].DefaultValue = proto.String(string(make([]byte, 300)))
+	msg.MessageType[0].Field[0].Number = proto.Int32(-70000)
+	msgData, err := p.Marshal(1, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Unmarshal(1, msgData[4:])
+	if err != nil || !proto.Equal(got, msg) {
+		t.Fatalf("got %v, err %v", got, err)
+	}
+
+	// {"name": "a.proto", 3: ["b.proto"], "unknown": [nil, 1.5], "syntax": nil}
+	partner := []byte{0x84, 0xa4, 'n', 'a', 'm', 'e', 0xa7, 'a', '.', 'p', 'r', 'o', 't', 'o',
+		0x03, 0x91, 0xa7, 'b', '.', 'p', 'r', 'o', 't', 'o',
+		0xa7, 'u', 'n', 'k', 'n', 'o', 'w', 'n', 0x92, 0xc0, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0xa6, 's', 'y', 'n', 't', 'a', 'x', 0xc0}
+	got, err = p.Unmarshal(1, partner)
+	file, _ := got.(*descriptorpb.FileDescriptorProto)
+	if err != nil || file.GetName() != "a.proto" || len(file.Dependency) != 1 || file.Dependency[0] != "b.proto" {
+		t.Fatalf("got %v, err %v", got, err)
+	}
+
+	if _, err := p.Unmarshal(1, msgData[4:len(msgData)-1]); err == nil {
+		t.Fatal("truncated data decoded")
+	}
+}
+
+func TestMsgPackMap(t *testing.T) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("game/bag.proto"),
+		Package: proto.String("game"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Bag"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("items"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".game.Bag.ItemsEntry"),
+			}},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name:    proto.String("ItemsEntry"),
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:   proto.String("key"),
+					Number: proto.Int32(1),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}, {
+					Name:   proto.String("value"),
+					Number: proto.Int32(2),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+				}},
+			}},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgDesc := fd.Messages().Get(0)
+	msg := dynamicpb.NewMessage(msgDesc)
+	items := msg.Mutable(msgDesc.Fields().Get(0)).Map()
+	items.Set(protoreflect.ValueOfString("gold").MapKey(), protoreflect.ValueOfInt32(100))
+	items.Set(protoreflect.ValueOfString("sword").MapKey(), protoreflect.ValueOfInt32(-1))
+
+	got := dynamicpb.NewMessage(msgDesc)
+	if err := unmarshalMsgPack(marshalMsgPack(msg), got); err != nil || !proto.Equal(got, msg) {
+		t.Fatalf("got %v, err %v", got, err)
+	}
+}
+
+func benchmarkCodec(b *testing.B, p Processor) {
+	p.Register(1, &descriptorpb.FileDescriptorProto{}, func(clientId uint64, msg proto.Message) {})
+	msg := testFileDescriptor()
+	msgData, err := p.Marshal(1, msg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Marshal", func(b *testing.B) {
+		b.SetBytes(int64(len(msgData)))
+		for i := 0; i < b.N; i++ {
+			p.Marshal(1, msg)
+		}
+	})
+	b.Run("Route", func(b *testing.B) {
+		b.SetBytes(int64(len(msgData)))
+		for i := 0; i < b.N; i++ {
+			p.Route(1, msgData)
+		}
+	})
+}
+
+func BenchmarkPBCodec(b *testing.B) {
+	benchmarkCodec(b, NewProcessor(CODEC_PROTOBUF))
+}
+
+func BenchmarkJSONCodec(b *testing.B) {
+	benchmarkCodec(b, NewProcessor(CODEC_JSON))
+}
+
+func BenchmarkMsgPackCodec(b *testing.B) {
+	benchmarkCodec(b, NewProcessor(CODEC_MSGPACK))
+}
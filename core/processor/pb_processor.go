@@ -4,28 +4,114 @@ import (
 	"gameserver/common/errors"
 	"gameserver/common/utils"
 	"gameserver/core/log"
+	"gameserver/core/processor/pb"
 	utils2 "gameserver/core/utils"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type MessageInfo struct {
 	msgType    reflect.Type
 	msgHandler MessageHandler
+
+	// set instead of msgType for msgs registered by RegisterDynamic
+	msgDesc protoreflect.MessageDescriptor
+
+	// msgHandler wrapped by the interceptors
+	handler CallHandler
+
+	// set for requests registered by RegisterRequest
+	reqHandler RequestHandler
+	respId     uint32
+
+	// handlers registered by RegisterVersion, sorted by minVersion desc
+	minVersion uint32
+	versions   []*MessageInfo
+
+	// nil unless EnablePool
+	pool *msgPool
+}
+
+func (this *MessageInfo) newMessage() proto.Message {
+	if this.pool != nil {
+		return this.pool.get()
+	}
+	return this.allocMessage()
+}
+
+func (this *MessageInfo) release(msg proto.Message) {
+	if this.pool != nil {
+		this.pool.put(msg)
+	}
 }
 
-type MessageHandler func(clientId uint64, msg proto.Message)
+// false for msgIds only registered by RegisterVersion
+func (this *MessageInfo) hasType() bool {
+	return this.msgType != nil || this.msgDesc != nil
+}
+
+func (this *MessageInfo) allocMessage() proto.Message {
+	if this.msgDesc != nil {
+		return newDynamicMessage(this.msgDesc)
+	}
+	return reflect.New(this.msgType.Elem()).Interface().(proto.Message)
+}
 
 type PBProcessor struct {
-	msgInfoList map[uint32]*MessageInfo
+	msgInfoList  map[uint32]*MessageInfo
+	respTypeList map[uint32]reflect.Type
+	sender       Sender
+	files        *protoregistry.Files
+
+	interceptors    []Interceptor
+	msgInterceptors map[uint32][]Interceptor
+
+	// *Metrics, nil unless EnableMetrics
+	metrics     atomic.Value
+	metricsLock sync.Mutex
+
+	// nil unless EnableHandshake
+	handshake *HandshakeConfig
+
+	// set by SetServerSender on servers behind a gateway
+	serverSender Sender
+
+	clients *clientStates
+
+	// nil unless EnableValidation
+	validation *validation
+	validators map[uint32][]Validator
+
+	// nil unless EnableIdempotency
+	idempotency *idempotency
+
+	tracer *Tracer
+
+	// nil unless SetBadFramePolicy
+	badFrame *BadFrameConfig
+
+	// nil unless EnableReliablePush
+	reliable *reliablePush
 
 	littleEndian bool
 }
 
 func NewPBProcessor() *PBProcessor {
 	return &PBProcessor{
-		msgInfoList:  make(map[uint32]*MessageInfo),
-		littleEndian: true,
+		msgInfoList: make(map[uint32]*MessageInfo),
+		respTypeList: map[uint32]reflect.Type{
+			ERROR_RESP_MSG_ID: reflect.TypeOf(&pb.ErrorResp{}),
+		},
+		msgInterceptors: make(map[uint32][]Interceptor),
+		clients:         newClientStates(),
+		validators:      make(map[uint32][]Validator),
+		tracer:          NewTracer(),
+		littleEndian:    true,
 	}
 }
 
@@ -34,19 +120,77 @@ func (this *PBProcessor) SetByteOrder(littleEndian bool) {
 }
 
 func (this *PBProcessor) Route(clientId uint64, msgData []byte) {
+	this.route(clientId, msgData)
+}
+
+// false if the msg is dropped before its handler
+func (this *PBProcessor) route(clientId uint64, msgData []byte) bool {
+	if len(msgData) < utils2.MSG_ID_LEN {
+		log.Warn("frame too short, clientId: %v, size: %v", clientId, len(msgData))
+		this.onBadFrame(clientId, BAD_FRAME_SHORT, 0, msgData, false)
+		return false
+	}
 	msgId := utils.ByteToUint32(msgData, this.littleEndian)
+	if msgId == HANDSHAKE_REQ_MSG_ID && this.handshake != nil {
+		this.routeHandshake(clientId, msgData)
+		return true
+	}
+	version, ok := this.checkHandshake(clientId, msgId)
+	if !ok {
+		return false
+	}
+	switch msgId {
+	case BATCH_MSG_ID:
+		this.routeBatch(clientId, msgData)
+		return true
+	case RELIABLE_PUSH_MSG_ID:
+		this.routeReliablePush(clientId, msgData)
+		return true
+	case PUSH_ACK_MSG_ID:
+		this.routePushAck(clientId, msgData)
+		return true
+	}
+
 	msgInfo, ok := this.msgInfoList[msgId]
 	if !ok {
-		log.Warn("msgId not found: ", msgId)
-		return
+		log.Warn("msgId not found: %v, clientId: %v", msgId, clientId)
+		this.onBadFrame(clientId, BAD_FRAME_UNKNOWN_MSG, msgId, msgData, false)
+		return false
+	}
+	metrics := this.Metrics()
+	metrics.addIn(msgId, len(msgData))
+	msgInfo = msgInfo.forVersion(version)
+	if msgInfo == nil {
+		log.Warn("no handler of msgId: %v for version: %v, clientId: %v", msgId, version, clientId)
+		this.onBadFrame(clientId, BAD_FRAME_UNKNOWN_MSG, msgId, msgData, false)
+		return false
+	}
+	if msgInfo.reqHandler != nil {
+		this.routeRequest(clientId, msgId, msgInfo, msgData)
+		return true
 	}
 
-	msg, err := this.Unmarshal(msgId, msgData[utils2.MSG_ID_LEN:])
+	msg, err := this.unmarshal(msgId, msgInfo, msgData[utils2.MSG_ID_LEN:])
 	if err != nil {
-		return
+		this.onBadFrame(clientId, BAD_FRAME_UNMARSHAL, msgId, msgData, false)
+		return false
+	}
+	if err := this.validate(clientId, msgId, msg); err != nil {
+		this.rejectMsg(clientId, msgId, err)
+		msgInfo.release(msg)
+		return false
 	}
 
-	msgInfo.msgHandler(clientId, msg)
+	text, traced := this.traceText(clientId, msgId, msg)
+	start := time.Now()
+	msgInfo.handler(&Call{ClientId: clientId, MsgId: msgId, processor: this}, msg)
+	cost := time.Since(start)
+	metrics.addLatency(msgId, cost)
+	if traced {
+		this.tracer.trace(TRACE_IN, clientId, msgId, len(msgData), cost, text)
+	}
+	msgInfo.release(msg)
+	return true
 }
 
 func (this *PBProcessor) Unmarshal(msgId uint32, msgData []byte) (proto.Message, error) {
@@ -55,12 +199,21 @@ func (this *PBProcessor) Unmarshal(msgId uint32, msgData []byte) (proto.Message,
 		log.Warn("msgId not found: ", msgId)
 		return nil, errors.ERROR_NOT_FOUND
 	}
+	if !msgInfo.hasType() {
+		log.Warn("msgId: %v has only version specific types", msgId)
+		return nil, errors.ERROR_NOT_FOUND
+	}
 
-	msgValue := reflect.New(msgInfo.msgType.Elem()).Interface()
-	msg := msgValue.(proto.Message)
+	return this.unmarshal(msgId, msgInfo, msgData)
+}
+
+func (this *PBProcessor) unmarshal(msgId uint32, msgInfo *MessageInfo, msgData []byte) (proto.Message, error) {
+	msg := msgInfo.newMessage()
 	err := proto.Unmarshal(msgData, msg)
 	if err != nil {
-		log.Warn("unmarshall error, msgId: ", msgId, "data: ", msgData)
+		msgInfo.release(msg)
+		log.Warn("unmarshall error, msgId: %v, size: %v, err: %v", msgId, len(msgData), err)
+		this.Metrics().addUnmarshalError(msgId)
 		return nil, err
 	}
 
@@ -76,7 +229,8 @@ func (this *PBProcessor) Marshal(msgId uint32, msg proto.Message) ([]byte, error
 
 	buf := make([]byte, len(msgData)+utils2.MSG_ID_LEN)
 	utils.PutUint32ToByte(buf, msgId, this.littleEndian)
-	copy(buf[:utils2.MSG_ID_LEN], msgData)
+	copy(buf[utils2.MSG_ID_LEN:], msgData)
+	this.Metrics().addOut(msgId, len(buf))
 
 	return buf, nil
 }
@@ -91,15 +245,23 @@ func (this *PBProcessor) MarshalServerMsg(msgId uint32, clientId uint64, msg pro
 	buf := make([]byte, len(msgData)+utils2.SERVER_MSG_HEAD_LEN)
 	utils.PutUint64ToByte(buf, clientId, this.littleEndian)
 	utils.PutUint32ToByte(buf[utils2.CLIENT_ID_LEN:], msgId, this.littleEndian)
-	copy(buf[:utils2.SERVER_MSG_HEAD_LEN], msgData)
+	copy(buf[utils2.SERVER_MSG_HEAD_LEN:], msgData)
 
 	return buf, nil
 }
 
 func (this *PBProcessor) Register(msgId uint32, msg proto.Message, msgHandler MessageHandler) {
+	checkHandler(msgId, msgHandler != nil)
+	this.checkDuplicate(msgId, messageName(msg))
 	reflectType := reflect.TypeOf(msg)
-	this.msgInfoList[msgId] = &MessageInfo{
+	msgInfo := &MessageInfo{
 		msgType:    reflectType,
 		msgHandler: msgHandler,
 	}
+	if old, ok := this.msgInfoList[msgId]; ok {
+		msgInfo.versions = old.versions
+	}
+	this.msgInfoList[msgId] = msgInfo
+	this.rebuildHandler(msgId)
+	this.loadRules(msgId)
 }
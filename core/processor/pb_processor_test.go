@@ -0,0 +1,928 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"gameserver/core/processor/pb"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPBProcessorInterceptor(t *testing.T) {
+	p := NewPBProcessor()
+
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(call *Call, msg proto.Message, next CallHandler) {
+			order = append(order, name)
+			next(call, msg)
+		}
+	}
+
+	var got *descriptorpb.FileOptions
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		order = append(order, "handler")
+		got = msg.(*descriptorpb.FileOptions)
+		panic("boom")
+	})
+	p.UseFor(1, trace("msg"))
+	p.Use(RecoverInterceptor(nil), trace("global"))
+
+	msgData, err := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String("game")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Route(1, msgData)
+
+	if got.GetJavaPackage() != "game" {
+		t.Fatalf("got %v", got)
+	}
+	if len(order) != 3 || order[0] != "global" || order[1] != "msg" || order[2] != "handler" {
+		t.Fatalf("order %v", order)
+	}
+}
+
+// the msg follows the msgId head, it used to overwrite it
+func TestPBProcessorMarshal(t *testing.T) {
+	p := NewPBProcessor()
+	msg := &descriptorpb.FileOptions{JavaPackage: proto.String("game")}
+
+	msgData, err := p.Marshal(1, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := proto.Marshal(msg)
+	if len(msgData) != utils2.MSG_ID_LEN+len(body) || !bytes.Equal(msgData[utils2.MSG_ID_LEN:], body) {
+		t.Fatalf("msgData %x, body %x", msgData, body)
+	}
+	if msgData[0] != 1 {
+		t.Fatalf("msgId head %x", msgData[:utils2.MSG_ID_LEN])
+	}
+}
+
+func TestPBProcessorRequest(t *testing.T) {
+	p := NewPBProcessor()
+
+	var sent []byte
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		sent = msgData
+		return nil
+	})
+	p.RegisterRequest(1, &descriptorpb.FileOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			if msg.(*descriptorpb.FileOptions).GetJavaPackage() == "" {
+				return nil, NewCodeError(100, "empty package")
+			}
+			return &descriptorpb.MessageOptions{Deprecated: proto.Bool(true)}, nil
+		})
+	intercepted := 0
+	p.Use(func(call *Call, msg proto.Message, next CallHandler) {
+		if call.Request && call.Seq != 0 {
+			intercepted++
+		}
+		next(call, msg)
+	})
+
+	msgData, _ := p.MarshalRequest(1, 7, &descriptorpb.FileOptions{JavaPackage: proto.String("game")})
+	p.Route(1, msgData)
+	msgId, seq, resp, err := p.UnmarshalResponse(sent)
+	if err != nil || msgId != 2 || seq != 7 || !resp.(*descriptorpb.MessageOptions).GetDeprecated() || intercepted != 1 {
+		t.Fatalf("msgId %v, seq %v, resp %v, err %v, intercepted %v", msgId, seq, resp, err, intercepted)
+	}
+
+	msgData, _ = p.MarshalRequest(1, 8, &descriptorpb.FileOptions{})
+	p.Route(1, msgData)
+	msgId, seq, _, err = p.UnmarshalResponse(sent)
+	if codeErr, ok := err.(*CodeError); !ok || codeErr.Code != 100 || msgId != ERROR_RESP_MSG_ID || seq != 8 {
+		t.Fatalf("msgId %v, seq %v, err %v", msgId, seq, err)
+	}
+
+	// a panic is replied with the seq of the request
+	p.RegisterRequest(3, &descriptorpb.EnumOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			panic("boom")
+		})
+	p.UseFor(3, RecoverInterceptor(nil))
+	msgData, _ = p.MarshalRequest(3, 9, &descriptorpb.EnumOptions{})
+	p.Route(1, msgData)
+	msgId, seq, _, err = p.UnmarshalResponse(sent)
+	if codeErr, ok := err.(*CodeError); !ok || codeErr.Code != ERROR_CODE_INTERNAL || msgId != ERROR_RESP_MSG_ID || seq != 9 {
+		t.Fatalf("msgId %v, seq %v, err %v", msgId, seq, err)
+	}
+}
+
+func TestPBProcessorDynamic(t *testing.T) {
+	opts := &descriptorpb.MessageOptions{}
+	proto.SetExtension(opts, pb.E_MsgId, proto.Uint32(1001))
+	nestedOpts := &descriptorpb.MessageOptions{}
+	proto.SetExtension(nestedOpts, pb.E_MsgId, proto.Uint32(1002))
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("game/chat.proto"),
+		Package: proto.String("game"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:    proto.String("ChatReq"),
+			Options: opts,
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name:    proto.String("Ack"),
+				Options: nestedOpts,
+			}},
+		}},
+	}}}
+
+	p := NewPBProcessor()
+	if err := p.LoadDescriptorSet(fds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.RegisterDynamicAll(nil); err == nil {
+		t.Fatal("nil handler registered")
+	}
+	var got proto.Message
+	if n, err := p.RegisterDynamicAll(func(clientId uint64, msg proto.Message) { got = msg }); n != 2 || err != nil {
+		t.Fatalf("registered %v, err %v", n, err)
+	}
+
+	// {text: "hi"}
+	p.Route(1, []byte{0xe9, 0x03, 0, 0, 0x0a, 0x02, 'h', 'i'})
+	msgData, err := p.Marshal(1001, got)
+	if err != nil || !bytes.Equal(msgData, []byte{0xe9, 0x03, 0, 0, 0x0a, 0x02, 'h', 'i'}) {
+		t.Fatalf("re-encoded %v, err %v, msg %v", msgData, err, got)
+	}
+}
+
+func TestPBProcessorMetrics(t *testing.T) {
+	p := NewPBProcessor()
+	metrics := p.EnableMetrics()
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {})
+
+	msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String("game")})
+	p.Route(1, msgData)
+	p.Route(1, msgData)
+	p.Route(1, []byte{1, 0, 0, 0, 0xff})
+
+	snapshot := metrics.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("snapshot %v", snapshot)
+	}
+	m := snapshot[0]
+	if m.InCount != 3 || m.InBytes != int64(2*len(msgData)+5) || m.OutCount != 1 || m.UnmarshalErrors != 1 || m.HandleCount != 2 {
+		t.Fatalf("metrics %+v", m)
+	}
+	if metrics.Summary(5) == "" || m.Percentile(0.99) == 0 {
+		t.Fatalf("summary %v, p99 %v", metrics.Summary(5), m.Percentile(0.99))
+	}
+
+	metrics.Reset()
+	if len(metrics.Snapshot()) != 0 {
+		t.Fatal("reset failed")
+	}
+}
+
+// run with -race
+func TestPBProcessorMetricsToggle(t *testing.T) {
+	p := NewPBProcessor()
+	p.Register(1, &descriptorpb.FileOptions{}, handleFileOptions)
+	msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.EnableMetrics().StartReport(time.Hour, 1)
+			p.DisableMetrics()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		p.Route(1, msgData)
+		p.Marshal(1, &descriptorpb.FileOptions{})
+	}
+	<-done
+
+	if p.Metrics() != nil {
+		t.Fatal("metrics not disabled")
+	}
+}
+
+func TestPBProcessorHandshake(t *testing.T) {
+	p := NewPBProcessor()
+
+	var sent []byte
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		sent = msgData
+		return nil
+	})
+	var rejected []uint64
+	p.EnableHandshake(&HandshakeConfig{
+		MinVersion:   2,
+		MaxVersion:   4,
+		Capabilities: 0x3,
+		Required:     true,
+		OnReject: func(clientId uint64, version uint32) {
+			rejected = append(rejected, clientId)
+		},
+	})
+
+	var handled []string
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		handled = append(handled, "base")
+	})
+	p.RegisterVersion(1, 3, &descriptorpb.MessageOptions{}, func(clientId uint64, msg proto.Message) {
+		handled = append(handled, "v3")
+	})
+
+	handshake := func(clientId uint64, version uint32) *pb.HandshakeResp {
+		msgData, _ := p.Marshal(HANDSHAKE_REQ_MSG_ID, &pb.HandshakeReq{Version: version, Capabilities: 0x6})
+		p.Route(clientId, msgData)
+		resp := &pb.HandshakeResp{}
+		unmarshalFrame(t, sent, resp)
+		return resp
+	}
+
+	msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{})
+	p.Route(1, msgData)
+	p.Route(1, p.MarshalBatch(msgData))
+	if len(handled) != 0 {
+		t.Fatalf("routed before handshake: %v", handled)
+	}
+
+	p.RegisterVersion(2, 3, &descriptorpb.MessageOptions{}, func(clientId uint64, msg proto.Message) {})
+	if _, err := p.Unmarshal(2, nil); err == nil {
+		t.Fatal("unmarshaled msgId without a base type")
+	}
+
+	if resp := handshake(1, 1); resp.Code != ERROR_CODE_UNSUPPORTED_VERSION || len(rejected) != 1 {
+		t.Fatalf("resp %v, rejected %v", resp, rejected)
+	}
+	if resp := handshake(2, 2); resp.Code != 0 || resp.Version != 2 || resp.Capabilities != 0x2 {
+		t.Fatalf("resp %v", resp)
+	}
+	if resp := handshake(3, 9); resp.Code != 0 || resp.Version != 4 {
+		t.Fatalf("resp %v", resp)
+	}
+
+	p.Route(2, msgData)
+	p.Route(3, msgData)
+	if len(handled) != 2 || handled[0] != "base" || handled[1] != "v3" {
+		t.Fatalf("handled %v", handled)
+	}
+
+	p.RemoveClient(3)
+	if _, _, ok := p.ClientVersion(3); ok {
+		t.Fatal("client not removed")
+	}
+}
+
+func TestPBProcessorShareClients(t *testing.T) {
+	login := NewPBProcessor()
+	login.EnableHandshake(&HandshakeConfig{MinVersion: 1, MaxVersion: 1, Required: true})
+	chat := NewPBProcessor()
+	chat.ShareClients(login)
+
+	var handled int
+	chat.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		handled++
+	})
+
+	msgData, _ := chat.Marshal(1, &descriptorpb.FileOptions{})
+	chat.Route(1, msgData)
+	if handled != 0 {
+		t.Fatal("routed before handshake")
+	}
+
+	handshake, _ := login.Marshal(HANDSHAKE_REQ_MSG_ID, &pb.HandshakeReq{Version: 1})
+	login.Route(1, handshake)
+	chat.Route(1, msgData)
+	if handled != 1 {
+		t.Fatal("not routed after handshake")
+	}
+}
+
+func TestPBProcessorPool(t *testing.T) {
+	p := NewPBProcessor()
+
+	var kept []*descriptorpb.FileOptions
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		kept = append(kept, msg.(*descriptorpb.FileOptions))
+	})
+	p.EnablePool(1, true)
+
+	msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String("game")})
+	p.Route(1, msgData)
+	if kept[0].GetJavaPackage() != "" {
+		t.Fatalf("msg not reset: %v", kept[0])
+	}
+
+	kept[0].JavaPackage = proto.String("modified")
+	for i := 0; i < POOL_QUARANTINE_LEN; i++ {
+		p.Route(1, msgData)
+	}
+	if p.PoolRetained(1) != 1 {
+		t.Fatalf("retained %v", p.PoolRetained(1))
+	}
+}
+
+type testWriter struct {
+	msgs [][]byte
+}
+
+func (this *testWriter) WriteMsg(args ...[]byte) error {
+	this.msgs = append(this.msgs, bytes.Join(args, nil))
+	return nil
+}
+
+func TestPBProcessorBatch(t *testing.T) {
+	p := NewPBProcessor()
+
+	var got []string
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		got = append(got, msg.(*descriptorpb.FileOptions).GetJavaPackage())
+	})
+
+	writer := &testWriter{}
+	batcher := p.NewBatcher(writer, 40, 0)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String(name)})
+		if err := batcher.Write(msgData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batcher.Close()
+	if len(writer.msgs) != 2 {
+		t.Fatalf("%v msgs written", len(writer.msgs))
+	}
+
+	for _, msgData := range writer.msgs {
+		p.Route(1, msgData)
+	}
+	if len(got) != 5 || got[0] != "a" || got[4] != "e" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// run with -race, the flush timer must not race Write
+func TestBatcherTimer(t *testing.T) {
+	p := NewPBProcessor()
+
+	var got []*descriptorpb.FileOptions
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		got = append(got, msg.(*descriptorpb.FileOptions))
+	})
+
+	writer := &testWriter{}
+	batcher := p.NewBatcher(writer, 64, time.Microsecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(writer string) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				msgData, _ := p.Marshal(1, &descriptorpb.FileOptions{JavaPackage: proto.String(writer), GoPackage: proto.String(fmt.Sprint(n))})
+				if err := batcher.Write(msgData); err != nil {
+					t.Error(err)
+				}
+			}
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	batcher.Close()
+
+	for _, msgData := range writer.msgs {
+		if len(msgData) <= utils2.MSG_ID_LEN {
+			t.Fatalf("empty frame written: %v", msgData)
+		}
+		p.Route(1, msgData)
+	}
+	next := make(map[string]int)
+	for _, msg := range got {
+		if msg.GetGoPackage() != fmt.Sprint(next[msg.GetJavaPackage()]) {
+			t.Fatalf("writer %v got %v, want %v", msg.GetJavaPackage(), msg.GetGoPackage(), next[msg.GetJavaPackage()])
+		}
+		next[msg.GetJavaPackage()]++
+	}
+	if len(got) != 800 {
+		t.Fatalf("got %v msgs", len(got))
+	}
+}
+
+func TestPBProcessorServerMsg(t *testing.T) {
+	gate := NewPBProcessor()
+	server := NewPBProcessor()
+
+	toClient := make(map[uint64][]byte)
+	gate.SetSender(func(clientId uint64, msgData []byte) error {
+		toClient[clientId] = msgData
+		return nil
+	})
+	server.SetServerSender(func(serverId uint64, msgData []byte) error {
+		if serverId != 100 {
+			t.Fatalf("serverId %v", serverId)
+		}
+		return gate.ForwardToClient(msgData)
+	})
+	server.RegisterRequest(1, &descriptorpb.FileOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			return &descriptorpb.MessageOptions{Deprecated: proto.Bool(clientId == 7)}, nil
+		})
+	gate.RegisterResponse(2, &descriptorpb.MessageOptions{})
+
+	msgData, _ := gate.MarshalRequest(1, 3, &descriptorpb.FileOptions{})
+	server.RouteServerMsg(100, gate.WrapServerMsg(7, msgData))
+	msgId, seq, resp, err := gate.UnmarshalResponse(toClient[7])
+	if err != nil || msgId != 2 || seq != 3 || !resp.(*descriptorpb.MessageOptions).GetDeprecated() {
+		t.Fatalf("msgId %v, seq %v, resp %v, err %v", msgId, seq, resp, err)
+	}
+
+	server.Register(4, &descriptorpb.FileOptions{}, handleFileOptions)
+	frame, _ := server.MarshalServerMsg(4, 8, &descriptorpb.FileOptions{JavaPackage: proto.String("push")})
+	clientId, msgId, msg, err := server.UnmarshalServerMsg(frame)
+	if err != nil || clientId != 8 || msgId != 4 || msg.(*descriptorpb.FileOptions).GetJavaPackage() != "push" {
+		t.Fatalf("clientId %v, msgId %v, msg %v, err %v", clientId, msgId, msg, err)
+	}
+	if err := server.SendToPlayer(100, 8, 4, &descriptorpb.FileOptions{}); err != nil || len(toClient[8]) != 4 {
+		t.Fatalf("push %v, err %v", toClient[8], err)
+	}
+
+	server.RouteServerMsg(100, gate.MarshalClientClosed(7))
+	if _, ok := server.ClientGateway(7); ok {
+		t.Fatal("closed client not removed")
+	}
+}
+
+func handleFileOptions(clientId uint64, msg proto.Message) {}
+
+// decode a frame made by Marshal into msg
+func unmarshalFrame(t *testing.T, frame []byte, msg proto.Message) {
+	if len(frame) < utils2.MSG_ID_LEN {
+		t.Fatalf("frame %x", frame)
+	}
+	if err := proto.Unmarshal(frame[utils2.MSG_ID_LEN:], msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPBProcessorCatalog(t *testing.T) {
+	p := NewPBProcessor()
+	p.Register(1, &descriptorpb.FileOptions{}, handleFileOptions)
+	p.RegisterRequest(2, &descriptorpb.FieldOptions{}, 3, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) { return nil, nil })
+
+	entries := p.Catalog()
+	if len(entries) != 4 {
+		t.Fatalf("%v entries", len(entries))
+	}
+	if entries[0].Name != "google.protobuf.FileOptions" || entries[0].Handler != "gameserver/core/processor.handleFileOptions" {
+		t.Fatalf("entry %+v", entries[0])
+	}
+	if entries[1].Kind != CATALOG_REQUEST || entries[1].RespId != 3 || entries[2].Kind != CATALOG_RESPONSE {
+		t.Fatalf("entries %+v %+v", entries[1], entries[2])
+	}
+	if entries[3].MsgId != ERROR_RESP_MSG_ID || entries[3].Fields[0].Name != "req_msg_id" {
+		t.Fatalf("entry %+v", entries[3])
+	}
+
+	if _, err := p.CatalogJSON(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(p.CatalogMarkdown(), "| java_package | 1 | string |") {
+		t.Fatal(p.CatalogMarkdown())
+	}
+}
+
+func TestPBProcessorValidation(t *testing.T) {
+	nameOpts := &descriptorpb.FieldOptions{}
+	proto.SetExtension(nameOpts, pb.E_MaxLen, proto.Uint32(4))
+	proto.SetExtension(nameOpts, pb.E_Pattern, proto.String("^[a-z]*$"))
+	levelOpts := &descriptorpb.FieldOptions{}
+	proto.SetExtension(levelOpts, pb.E_Min, proto.Float64(1))
+	proto.SetExtension(levelOpts, pb.E_Max, proto.Float64(100))
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("game/role.proto"),
+		Package: proto.String("game"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("CreateRole"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:    proto.String("name"),
+				Number:  proto.Int32(1),
+				Label:   descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:    descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Options: nameOpts,
+			}, {
+				Name:    proto.String("level"),
+				Number:  proto.Int32(2),
+				Label:   descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:    descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+				Options: levelOpts,
+			}},
+		}},
+	}}}
+
+	p := NewPBProcessor()
+	if err := p.LoadDescriptorSet(fds); err != nil {
+		t.Fatal(err)
+	}
+	var sent []byte
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		sent = msgData
+		return nil
+	})
+	var violations int64
+	p.EnableValidation(&ValidationConfig{
+		OnViolation: func(clientId uint64, msgId uint32, n int64, err error) { violations = n },
+	})
+	handled := 0
+	p.RegisterDynamic(1, "game.CreateRole", func(clientId uint64, msg proto.Message) { handled++ })
+
+	route := func(name string, level int) {
+		sent = nil
+		msgData := []byte{1, 0, 0, 0, 0x0a, byte(len(name))}
+		msgData = append(msgData, name...)
+		if level != 0 {
+			msgData = append(msgData, 0x10, byte(level))
+		}
+		p.Route(1, msgData)
+	}
+
+	route("abc", 10)
+	if handled != 1 || sent != nil {
+		t.Fatalf("handled %v, sent %v", handled, sent)
+	}
+	for _, c := range []struct {
+		name  string
+		level int
+		field string
+	}{{"abcde", 10, "name"}, {"ABC", 10, "name"}, {"abc", 0, "level"}, {"abc", 101, "level"}} {
+		route(c.name, c.level)
+		errResp := &pb.ErrorResp{}
+		unmarshalFrame(t, sent, errResp)
+		if errResp.Code != ERROR_CODE_INVALID_MSG || !strings.HasPrefix(errResp.Message, c.field) {
+			t.Fatalf("%+v: resp %v", c, errResp)
+		}
+	}
+
+	if handled != 1 || violations != 4 || p.ClientViolations(1) != 4 {
+		t.Fatalf("handled %v, violations %v", handled, violations)
+	}
+
+	// an invalid pattern is found when the rules are built, not in Route
+	proto.SetExtension(nameOpts, pb.E_Pattern, proto.String("[a-z"))
+	fd, err := protodesc.NewFile(fds.File[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildRules(fd.Messages().Get(0)); err == nil {
+		t.Fatal("invalid pattern built")
+	}
+}
+
+func TestPBProcessorIdempotency(t *testing.T) {
+	p := NewPBProcessor()
+
+	var sent [][]byte
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		sent = append(sent, msgData)
+		return nil
+	})
+	granted := 0
+	p.RegisterRequest(1, &descriptorpb.FileOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			granted++
+			return &descriptorpb.MessageOptions{Deprecated: proto.Bool(true)}, nil
+		})
+	p.EnableIdempotency(time.Minute, 1)
+
+	buy, _ := p.MarshalRequest(1, 5, &descriptorpb.FileOptions{JavaPackage: proto.String("sword")})
+	p.Route(1, buy)
+	p.Route(1, buy)
+	if granted != 1 || len(sent) != 2 || !bytes.Equal(sent[0], sent[1]) {
+		t.Fatalf("granted %v, sent %v", granted, sent)
+	}
+
+	// another client, or the same seq with another payload
+	p.Route(2, buy)
+	other, _ := p.MarshalRequest(1, 5, &descriptorpb.FileOptions{JavaPackage: proto.String("shield")})
+	p.Route(1, other)
+	if granted != 3 {
+		t.Fatalf("granted %v", granted)
+	}
+
+	// a retry after a panic runs the handler again
+	tries := 0
+	p.RegisterRequest(3, &descriptorpb.FileOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			tries++
+			if tries == 1 {
+				panic("first try")
+			}
+			return &descriptorpb.MessageOptions{}, nil
+		})
+	p.EnableIdempotency(time.Minute, 3)
+	retry, _ := p.MarshalRequest(3, 6, &descriptorpb.FileOptions{})
+	func() {
+		defer func() { recover() }()
+		p.Route(1, retry)
+	}()
+	p.Route(1, retry)
+	if tries != 2 {
+		t.Fatalf("tries %v", tries)
+	}
+
+	// a request replaced by one with the same seq and another payload while
+	// running does not store its reply for the other
+	nested := false
+	p.RegisterRequest(4, &descriptorpb.FileOptions{}, 2, &descriptorpb.MessageOptions{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			pkg := msg.(*descriptorpb.FileOptions).GetJavaPackage()
+			if pkg == "a" && !nested {
+				nested = true
+				b, _ := p.MarshalRequest(4, 7, &descriptorpb.FileOptions{JavaPackage: proto.String("b")})
+				p.Route(1, b)
+			}
+			return &descriptorpb.MessageOptions{Deprecated: proto.Bool(pkg == "b")}, nil
+		})
+	p.EnableIdempotency(time.Minute, 4)
+	a, _ := p.MarshalRequest(4, 7, &descriptorpb.FileOptions{JavaPackage: proto.String("a")})
+	p.Route(1, a)
+	replyB := sent[len(sent)-2]
+	b, _ := p.MarshalRequest(4, 7, &descriptorpb.FileOptions{JavaPackage: proto.String("b")})
+	p.Route(1, b)
+	if !bytes.Equal(sent[len(sent)-1], replyB) {
+		t.Fatalf("reply %x, want %x", sent[len(sent)-1], replyB)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer()
+	tracer.Redact("java_package", "google.protobuf.FileOptions.go_package", "cc_enable_arenas")
+
+	msg := &descriptorpb.FileDescriptorProto{
+		Name: proto.String("a.proto"),
+		Options: &descriptorpb.FileOptions{
+			JavaPackage:    proto.String("secret1"),
+			GoPackage:      proto.String("secret2"),
+			CcEnableArenas: proto.Bool(true),
+		},
+	}
+	text := tracer.Format(msg)
+	if strings.Contains(text, "secret") || strings.Contains(text, "cc_enable_arenas") ||
+		!strings.Contains(text, REDACTED) || !strings.Contains(text, "a.proto") {
+		t.Fatal(text)
+	}
+	if msg.Options.GetJavaPackage() != "secret1" {
+		t.Fatal("msg modified")
+	}
+
+	// map<string, Item> items, Item has a token
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("game/bag.proto"),
+		Package: proto.String("game"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Item"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:   proto.String("token"),
+				Number: proto.Int32(1),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}, {
+			Name: proto.String("Bag"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("items"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".game.Bag.ItemsEntry"),
+			}},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name:    proto.String("ItemsEntry"),
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:   proto.String("key"),
+					Number: proto.Int32(1),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}, {
+					Name:     proto.String("value"),
+					Number:   proto.Int32(2),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+					TypeName: proto.String(".game.Item"),
+				}},
+			}},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := dynamicpb.NewMessage(fd.Messages().Get(0))
+	item.Set(item.Descriptor().Fields().Get(0), protoreflect.ValueOfString("secret3"))
+	bag := dynamicpb.NewMessage(fd.Messages().Get(1))
+	items := bag.Mutable(bag.Descriptor().Fields().Get(0)).Map()
+	items.Set(protoreflect.ValueOfString("sword").MapKey(), protoreflect.ValueOfMessage(item))
+	if text := NewTracer().Format(bag); strings.Contains(text, "secret") || !strings.Contains(text, "sword") {
+		t.Fatal(text)
+	}
+
+	if tracer.Enabled(1, 2) {
+		t.Fatal("enabled by default")
+	}
+	tracer.TraceClient(1, true)
+	tracer.TraceMsg(3, true)
+	if !tracer.Enabled(1, 2) || !tracer.Enabled(2, 3) || tracer.Enabled(2, 2) {
+		t.Fatal("trace switches")
+	}
+	tracer.TraceClient(1, false)
+	if tracer.Enabled(1, 2) {
+		t.Fatal("client still traced")
+	}
+}
+
+func TestPBProcessorBadFrame(t *testing.T) {
+	p := NewPBProcessor()
+
+	var sent []byte
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		sent = msgData
+		return nil
+	})
+	var fallback []uint32
+	var out []uint64
+	p.SetBadFramePolicy(&BadFrameConfig{
+		Short:     &BadFramePolicy{Strikes: 2},
+		Unmarshal: &BadFramePolicy{ReplyCode: ERROR_CODE_BAD_REQUEST, Strikes: 1},
+		UnknownMsg: &BadFramePolicy{
+			Fallback: func(clientId uint64, kind int, msgId uint32, msgData []byte) {
+				fallback = append(fallback, msgId)
+			},
+		},
+		MaxStrikes:  4,
+		OnStrikeOut: func(clientId uint64, strikes int) { out = append(out, clientId) },
+	})
+	p.Register(1, &descriptorpb.FileOptions{}, handleFileOptions)
+
+	p.Route(1, []byte{9, 0, 0, 0})
+	if len(fallback) != 1 || fallback[0] != 9 || p.ClientStrikes(1) != 0 {
+		t.Fatalf("fallback %v, strikes %v", fallback, p.ClientStrikes(1))
+	}
+
+	p.Route(1, []byte{1, 0, 0, 0, 0xff})
+	errResp := &pb.ErrorResp{}
+	unmarshalFrame(t, sent, errResp)
+	if errResp.GetCode() != ERROR_CODE_BAD_REQUEST || errResp.GetReqMsgId() != 1 {
+		t.Fatalf("reply %v", errResp)
+	}
+
+	p.Route(1, []byte{1, 0})
+	p.Route(1, nil)
+	if p.ClientStrikes(1) != 5 || len(out) != 1 || out[0] != 1 {
+		t.Fatalf("strikes %v, out %v", p.ClientStrikes(1), out)
+	}
+
+	// default reply codes, and strikes expire with the window
+	p.SetBadFramePolicy(&BadFrameConfig{
+		UnknownMsg:   &BadFramePolicy{Reply: true},
+		Batch:        &BadFramePolicy{Reply: true, Strikes: 2},
+		MaxStrikes:   2,
+		StrikeWindow: 20 * time.Millisecond,
+		OnStrikeOut:  func(clientId uint64, strikes int) { out = append(out, clientId) },
+	})
+	p.Route(2, []byte{9, 0, 0, 0})
+	unmarshalFrame(t, sent, errResp)
+	if errResp.GetCode() != ERROR_CODE_UNKNOWN_MSG {
+		t.Fatalf("reply %v", errResp)
+	}
+
+	nested := p.MarshalBatch(p.MarshalBatch())
+	p.Route(2, nested)
+	unmarshalFrame(t, sent, errResp)
+	if errResp.GetCode() != ERROR_CODE_BAD_REQUEST || errResp.GetReqMsgId() != BATCH_MSG_ID || len(out) != 2 {
+		t.Fatalf("reply %v, out %v", errResp, out)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if p.ClientStrikes(2) != 0 {
+		t.Fatalf("strikes %v after the window", p.ClientStrikes(2))
+	}
+	p.Route(2, nested)
+	if len(out) != 3 {
+		t.Fatalf("out %v", out)
+	}
+}
+
+func TestPBProcessorReliablePush(t *testing.T) {
+	server := NewPBProcessor()
+	client := NewPBProcessor()
+	store := NewMemoryPushStore(0)
+	server.EnableReliablePush(store)
+
+	online := true
+	var got []string
+	client.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		got = append(got, msg.(*descriptorpb.FileOptions).GetJavaPackage())
+	})
+	client.SetSender(func(clientId uint64, msgData []byte) error {
+		server.Route(5, msgData)
+		return nil
+	})
+	server.SetSender(func(clientId uint64, msgData []byte) error {
+		if online {
+			client.Route(0, msgData)
+		}
+		return nil
+	})
+
+	server.SendReliable(100, 1, &descriptorpb.FileOptions{JavaPackage: proto.String("offline")})
+	server.LoginPlayer(5, 100)
+	server.SendReliable(100, 1, &descriptorpb.FileOptions{JavaPackage: proto.String("online")})
+	if pending, _ := store.Pending(100); len(pending) != 0 || len(got) != 2 || got[0] != "offline" {
+		t.Fatalf("pending %v, got %v", pending, got)
+	}
+
+	// lost with the connection
+	online = false
+	server.SendReliable(100, 1, &descriptorpb.FileOptions{JavaPackage: proto.String("lost")})
+	server.RemoveClient(5)
+	online = true
+	server.LoginPlayer(5, 100)
+	if pending, _ := store.Pending(100); len(pending) != 0 || len(got) != 3 || got[2] != "lost" {
+		t.Fatalf("pending %v, got %v", pending, got)
+	}
+
+	// pushes sent while the player logs in arrive after the pending ones
+	server.RemoveClient(5)
+	got = nil
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.SendReliable(100, 1, &descriptorpb.FileOptions{})
+		}()
+	}
+	server.LoginPlayer(5, 100)
+	wg.Wait()
+	if pending, _ := store.Pending(100); len(pending) != 0 || len(got) != 50 || len(store.queues) != 0 {
+		t.Fatalf("pending %v, got %v, queues %v", len(pending), len(got), len(store.queues))
+	}
+}
+
+func TestPBProcessorPushOrder(t *testing.T) {
+	p := NewPBProcessor()
+
+	var acked []uint64
+	p.SetSender(func(clientId uint64, msgData []byte) error {
+		ack := &pb.PushAck{}
+		unmarshalFrame(t, msgData, ack)
+		acked = append(acked, ack.Seq)
+		return nil
+	})
+	var got []string
+	p.Register(1, &descriptorpb.FileOptions{}, func(clientId uint64, msg proto.Message) {
+		got = append(got, msg.(*descriptorpb.FileOptions).GetJavaPackage())
+	})
+
+	push := func(seq uint64, prevSeq uint64, msgId uint32) {
+		msg, _ := proto.Marshal(&descriptorpb.FileOptions{JavaPackage: proto.String(fmt.Sprint(seq))})
+		msgData, _ := p.Marshal(RELIABLE_PUSH_MSG_ID, &pb.ReliablePush{Seq: seq, PrevSeq: prevSeq, MsgId: msgId, Msg: msg})
+		p.Route(0, msgData)
+	}
+
+	push(12, 11, 1)
+	if len(got) != 0 || len(acked) != 0 {
+		t.Fatalf("got %v, acked %v", got, acked)
+	}
+	push(11, 0, 1)
+	if len(got) != 2 || got[0] != "11" || acked[len(acked)-1] != 12 {
+		t.Fatalf("got %v, acked %v", got, acked)
+	}
+
+	// skipped without a handler, so the next one is not held back
+	push(13, 12, 2)
+	push(14, 13, 1)
+	if len(got) != 3 || acked[len(acked)-1] != 14 {
+		t.Fatalf("got %v, acked %v", got, acked)
+	}
+
+	for seq := uint64(100); seq < 100+MAX_EARLY_PUSHES+10; seq++ {
+		push(seq+1, seq, 1)
+	}
+	state, _ := p.clients.get(0)
+	if len(state.earlyPushes) != MAX_EARLY_PUSHES {
+		t.Fatalf("%v early pushes", len(state.earlyPushes))
+	}
+}
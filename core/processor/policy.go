@@ -0,0 +1,162 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"gameserver/core/processor/pb"
+	"time"
+)
+
+// kinds of bad frames
+const (
+	BAD_FRAME_SHORT = 1 + iota
+	BAD_FRAME_UNKNOWN_MSG
+	BAD_FRAME_UNMARSHAL
+	BAD_FRAME_BATCH
+)
+
+// called with the whole frame
+type BadFrameHandler func(clientId uint64, kind int, msgId uint32, msgData []byte)
+
+type BadFramePolicy struct {
+	// handle the frame instead, forward it elsewhere for example
+	Fallback BadFrameHandler
+
+	// reply ErrorResp with ReplyCode, or if it is 0 with ERROR_CODE_UNKNOWN_MSG
+	// to unknown msgIds and ERROR_CODE_BAD_REQUEST to the rest. requests
+	// that fail to unmarshal are always replied ERROR_CODE_BAD_REQUEST
+	Reply     bool
+	ReplyCode int32
+
+	// strikes added to the client per frame
+	Strikes int
+}
+
+// a nil policy only logs the frame. Unmarshal covers the handshakes and
+// push acks as well, Batch the batches with invalid entries
+type BadFrameConfig struct {
+	Short      *BadFramePolicy
+	UnknownMsg *BadFramePolicy
+	Unmarshal  *BadFramePolicy
+	Batch      *BadFramePolicy
+
+	// OnStrikeOut is called once per window when the strikes of a client
+	// reach MaxStrikes within StrikeWindow, 0 for no window, the owner of the
+	// connection should disconnect it
+	MaxStrikes   int
+	StrikeWindow time.Duration
+	OnStrikeOut  func(clientId uint64, strikes int)
+}
+
+func (this *PBProcessor) SetBadFramePolicy(config *BadFrameConfig) {
+	this.badFrame = config
+}
+
+// strikes of the client in the current window
+func (this *PBProcessor) ClientStrikes(clientId uint64) int {
+	state, _ := this.clients.get(clientId)
+	if this.badFrame != nil && this.badFrame.windowPassed(&state, time.Now()) {
+		return 0
+	}
+	return state.strikes
+}
+
+func (this *BadFrameConfig) windowPassed(state *clientState, now time.Time) bool {
+	return this.StrikeWindow > 0 && now.Sub(state.strikeStart) > this.StrikeWindow
+}
+
+func (this *BadFrameConfig) policy(kind int) *BadFramePolicy {
+	switch kind {
+	case BAD_FRAME_SHORT:
+		return this.Short
+	case BAD_FRAME_UNKNOWN_MSG:
+		return this.UnknownMsg
+	case BAD_FRAME_UNMARSHAL:
+		return this.Unmarshal
+	case BAD_FRAME_BATCH:
+		return this.Batch
+	}
+	return nil
+}
+
+func (this *BadFramePolicy) code(kind int) int32 {
+	if this.ReplyCode != 0 {
+		return this.ReplyCode
+	}
+	if kind == BAD_FRAME_UNKNOWN_MSG {
+		return ERROR_CODE_UNKNOWN_MSG
+	}
+	return ERROR_CODE_BAD_REQUEST
+}
+
+// apply the bad frame policy to a frame found bad outside Route, by a
+// Dispatcher splitting a batch for example, msgData is the whole frame
+func (this *PBProcessor) ReportBadFrame(clientId uint64, kind int, msgId uint32, msgData []byte) {
+	this.onBadFrame(clientId, kind, msgId, msgData, false)
+}
+
+// the policy of a bad frame the caller has logged, replied is true if the
+// caller has replied the frame already
+func (this *PBProcessor) onBadFrame(clientId uint64, kind int, msgId uint32, msgData []byte, replied bool) {
+	if this.badFrame == nil {
+		return
+	}
+	policy := this.badFrame.policy(kind)
+	if policy == nil {
+		return
+	}
+
+	if policy.Fallback != nil {
+		policy.Fallback(clientId, kind, msgId, msgData)
+	} else if (policy.Reply || policy.ReplyCode != 0) && !replied {
+		this.sendError(clientId, msgId, NewCodeError(policy.code(kind), "bad frame"))
+	}
+
+	if policy.Strikes > 0 {
+		this.strike(clientId, policy.Strikes)
+	}
+}
+
+func (this *PBProcessor) strike(clientId uint64, n int) {
+	config := this.badFrame
+	now := time.Now()
+
+	strikes, out := 0, false
+	this.clients.update(clientId, func(state *clientState) {
+		if config.windowPassed(state, now) {
+			state.strikes = 0
+			state.struckOut = false
+		}
+		if state.strikes == 0 {
+			state.strikeStart = now
+		}
+		state.strikes += n
+		strikes = state.strikes
+
+		if config.MaxStrikes > 0 && strikes >= config.MaxStrikes && !state.struckOut {
+			state.struckOut = true
+			out = true
+		}
+	})
+
+	if out {
+		log.Warn("clientId: %v struck out, strikes: %v", clientId, strikes)
+		if config.OnStrikeOut != nil {
+			config.OnStrikeOut(clientId, strikes)
+		}
+	}
+}
+
+// ErrorResp without seq as ERROR_MSG_ID, for msgs that are not requests
+func (this *PBProcessor) sendError(clientId uint64, msgId uint32, codeErr *CodeError) {
+	resp := &pb.ErrorResp{
+		ReqMsgId: msgId,
+		Code:     codeErr.Code,
+		Message:  codeErr.Msg,
+	}
+	msgData, err := this.Marshal(ERROR_MSG_ID, resp)
+	if err != nil {
+		log.Error("marshal error resp error: %v", err)
+		return
+	}
+	this.send(clientId, ERROR_MSG_ID, resp, msgData)
+}
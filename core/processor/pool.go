@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"sync/atomic"
+)
+
+// released msgs held back in safe mode before they are reused
+const POOL_QUARANTINE_LEN = 64
+
+// msgs of one type, taken by Unmarshal and put back after the handler returns
+type msgPool struct {
+	sync.Mutex
+	msgId uint32
+	pool  sync.Pool
+
+	// a released msg is reset and quarantined, if it is not empty any more
+	// when it leaves the quarantine the handler kept and modified it. a
+	// handler that keeps it only to read it later sees it empty, undetected
+	safe       bool
+	quarantine []proto.Message
+	next       int
+	retained   int64
+}
+
+func newMsgPool(msgId uint32, msgInfo *MessageInfo, safe bool) *msgPool {
+	return &msgPool{
+		msgId: msgId,
+		pool: sync.Pool{
+			New: func() interface{} { return msgInfo.allocMessage() },
+		},
+		safe: safe,
+	}
+}
+
+func (this *msgPool) get() proto.Message {
+	return this.pool.Get().(proto.Message)
+}
+
+func (this *msgPool) put(msg proto.Message) {
+	msg.Reset()
+	if !this.safe {
+		this.pool.Put(msg)
+		return
+	}
+
+	this.Lock()
+	if len(this.quarantine) < POOL_QUARANTINE_LEN {
+		this.quarantine = append(this.quarantine, msg)
+		this.Unlock()
+		return
+	}
+	old := this.quarantine[this.next]
+	this.quarantine[this.next] = msg
+	this.next = (this.next + 1) % POOL_QUARANTINE_LEN
+	this.Unlock()
+
+	if proto.Size(old) != 0 {
+		atomic.AddInt64(&this.retained, 1)
+		log.Error("msgId: %v is retained by its handler, modified after return: %v", this.msgId, old)
+		return
+	}
+	this.pool.Put(old)
+}
+
+// reuse the msgs of msgId once its handler returns, handlers must not keep
+// the msg or any field of message type, copy them with proto.Clone instead.
+// safe mode detects handlers modifying msgs after return and is meant for
+// tests, it does not detect handlers only reading them after return, those
+// read an empty msg or one of a later request
+func (this *PBProcessor) EnablePool(msgId uint32, safe bool) {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		log.Fatal("enable pool of unregistered msgId: %v", msgId)
+	}
+
+	if msgInfo.msgType != nil || msgInfo.msgDesc != nil {
+		msgInfo.pool = newMsgPool(msgId, msgInfo, safe)
+	}
+	for _, versionInfo := range msgInfo.versions {
+		versionInfo.pool = newMsgPool(msgId, versionInfo, safe)
+	}
+}
+
+func (this *PBProcessor) DisablePool(msgId uint32) {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		return
+	}
+
+	msgInfo.pool = nil
+	for _, versionInfo := range msgInfo.versions {
+		versionInfo.pool = nil
+	}
+}
+
+// number of msgs of msgId found modified after their handler returned
+func (this *PBProcessor) PoolRetained(msgId uint32) int64 {
+	msgInfo, ok := this.msgInfoList[msgId]
+	if !ok {
+		return 0
+	}
+
+	var n int64
+	for _, info := range append([]*MessageInfo{msgInfo}, msgInfo.versions...) {
+		if info.pool != nil {
+			n += atomic.LoadInt64(&info.pool.retained)
+		}
+	}
+	return n
+}
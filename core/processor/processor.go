@@ -0,0 +1,53 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+)
+
+type MessageHandler func(clientId uint64, msg proto.Message)
+
+// a wire format: frames carry a msgId and a message registered for it
+type Processor interface {
+	Register(msgId uint32, msg proto.Message, msgHandler MessageHandler)
+	Route(clientId uint64, msgData []byte)
+	Marshal(msgId uint32, msg proto.Message) ([]byte, error)
+	Unmarshal(msgId uint32, msgData []byte) (proto.Message, error)
+}
+
+// a msg without a handler would panic the connection goroutine once routed,
+// RegisterResponse declares the msgs a client only decodes
+func checkHandler(msgId uint32, ok bool) {
+	if !ok {
+		log.Fatal("nil handler of msgId: %v", msgId)
+	}
+}
+
+var _ Processor = (*PBProcessor)(nil)
+var _ Processor = (*JSONProcessor)(nil)
+var _ Processor = (*MsgPackProcessor)(nil)
+
+// codec names of NewProcessor
+const (
+	CODEC_PROTOBUF = "protobuf"
+	CODEC_JSON     = "json"
+	CODEC_MSGPACK  = "msgpack"
+)
+
+// the processor of a listener by the codec in its config, protobuf if empty.
+// only PBProcessor has requests, the handshake, batches, validation, bad
+// frame policies and reliable pushes, the json and msgpack processors just
+// route msgs to their handlers and log bad frames
+func NewProcessor(codec string) Processor {
+	switch codec {
+	case CODEC_PROTOBUF, "":
+		return NewPBProcessor()
+	case CODEC_JSON:
+		return NewJSONProcessor()
+	case CODEC_MSGPACK:
+		return NewMsgPackProcessor()
+	}
+
+	log.Fatal("unknown codec: %v", codec)
+	return nil
+}
@@ -0,0 +1,319 @@
+package processor
+
+import (
+	"errors"
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	"gameserver/core/processor/pb"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+var ErrPushStoreFull = errors.New("push store full")
+
+// pushes a client holds while waiting for the one sent before them, more are
+// dropped and sent again on the next login
+const MAX_EARLY_PUSHES = 64
+
+type PushEntry struct {
+	Seq     uint64
+	MsgId   uint32
+	MsgData []byte
+}
+
+// keeps the pushes of a player until they are acked, a store shared by
+// several servers lets a player log in to any of them
+type PushStore interface {
+	// keep the msg under the next seq of playerId, seqs only grow, also
+	// across restarts and for players whose pushes were all acked, since
+	// clients drop pushes with seqs they have seen
+	Append(playerId uint64, msgId uint32, msgData []byte) (uint64, error)
+	// drop the msgs up to seq
+	Ack(playerId uint64, seq uint64) error
+	// unacked msgs in seq order
+	Pending(playerId uint64) ([]*PushEntry, error)
+}
+
+// lost on restart, for tests and single server setups
+type MemoryPushStore struct {
+	sync.Mutex
+	queues     map[uint64][]*PushEntry
+	maxPending int
+
+	// shared by the players so a queue can be dropped once it is acked,
+	// starts from the creation time so seqs grow across restarts
+	nextSeq uint64
+}
+
+// Append fails with ErrPushStoreFull once a player has maxPending unacked
+// msgs, 0 for no limit
+func NewMemoryPushStore(maxPending int) *MemoryPushStore {
+	return &MemoryPushStore{
+		queues:     make(map[uint64][]*PushEntry),
+		maxPending: maxPending,
+		nextSeq:    uint64(time.Now().UnixNano()),
+	}
+}
+
+func (this *MemoryPushStore) Append(playerId uint64, msgId uint32, msgData []byte) (uint64, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	queue := this.queues[playerId]
+	if this.maxPending > 0 && len(queue) >= this.maxPending {
+		return 0, ErrPushStoreFull
+	}
+
+	entry := &PushEntry{
+		Seq:     this.nextSeq,
+		MsgId:   msgId,
+		MsgData: msgData,
+	}
+	this.nextSeq++
+	this.queues[playerId] = append(queue, entry)
+
+	return entry.Seq, nil
+}
+
+func (this *MemoryPushStore) Ack(playerId uint64, seq uint64) error {
+	this.Lock()
+	defer this.Unlock()
+
+	queue := this.queues[playerId]
+	i := 0
+	for i < len(queue) && queue[i].Seq <= seq {
+		i++
+	}
+	if i == len(queue) {
+		delete(this.queues, playerId)
+	} else {
+		this.queues[playerId] = queue[i:]
+	}
+
+	return nil
+}
+
+func (this *MemoryPushStore) Pending(playerId uint64) ([]*PushEntry, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	return append([]*PushEntry(nil), this.queues[playerId]...), nil
+}
+
+// the players logged in on this processor
+type reliablePush struct {
+	sync.Mutex
+	store   PushStore
+	players map[uint64]uint64 // playerId -> clientId
+	clients map[uint64]uint64 // clientId -> playerId
+	sent    map[uint64]uint64 // clientId -> seq of the last push sent
+
+	// held from Append or Pending until the pushes are sent, so they are
+	// sent in seq order
+	sendLock sync.Mutex
+}
+
+// on the server, pushes sent by SendReliable are kept in store until the
+// client acks them and sent again when the player logs in
+func (this *PBProcessor) EnableReliablePush(store PushStore) {
+	this.reliable = &reliablePush{
+		store:   store,
+		players: make(map[uint64]uint64),
+		clients: make(map[uint64]uint64),
+		sent:    make(map[uint64]uint64),
+	}
+}
+
+// bind the connection of a player after it logs in, the pushes it has not
+// acked are sent again
+func (this *PBProcessor) LoginPlayer(clientId uint64, playerId uint64) error {
+	if this.reliable == nil {
+		return errors.New("reliable push not enabled")
+	}
+
+	this.reliable.sendLock.Lock()
+	defer this.reliable.sendLock.Unlock()
+
+	this.reliable.Lock()
+	if oldClientId, ok := this.reliable.players[playerId]; ok {
+		delete(this.reliable.clients, oldClientId)
+		delete(this.reliable.sent, oldClientId)
+	}
+	this.reliable.players[playerId] = clientId
+	this.reliable.clients[clientId] = playerId
+	delete(this.reliable.sent, clientId)
+	this.reliable.Unlock()
+
+	entries, err := this.reliable.store.Pending(playerId)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		this.sendPush(clientId, entry)
+	}
+
+	return nil
+}
+
+func (this *reliablePush) logout(clientId uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	if playerId, ok := this.clients[clientId]; ok {
+		delete(this.clients, clientId)
+		delete(this.sent, clientId)
+		if this.players[playerId] == clientId {
+			delete(this.players, playerId)
+		}
+	}
+}
+
+func (this *reliablePush) player(clientId uint64) (uint64, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	playerId, ok := this.clients[clientId]
+	return playerId, ok
+}
+
+func (this *reliablePush) client(playerId uint64) (uint64, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	clientId, ok := this.players[playerId]
+	return clientId, ok
+}
+
+// store msg and send it if the player is online, an error means the msg is
+// not stored
+func (this *PBProcessor) SendReliable(playerId uint64, msgId uint32, msg proto.Message) error {
+	if this.reliable == nil {
+		return errors.New("reliable push not enabled")
+	}
+
+	msgData, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	this.reliable.sendLock.Lock()
+	defer this.reliable.sendLock.Unlock()
+
+	seq, err := this.reliable.store.Append(playerId, msgId, msgData)
+	if err != nil {
+		return err
+	}
+
+	if clientId, ok := this.reliable.client(playerId); ok {
+		this.sendPush(clientId, &PushEntry{Seq: seq, MsgId: msgId, MsgData: msgData})
+	}
+	return nil
+}
+
+// with sendLock held
+func (this *PBProcessor) sendPush(clientId uint64, entry *PushEntry) {
+	this.reliable.Lock()
+	prevSeq := this.reliable.sent[clientId]
+	this.reliable.sent[clientId] = entry.Seq
+	this.reliable.Unlock()
+
+	push := &pb.ReliablePush{
+		Seq:     entry.Seq,
+		MsgId:   entry.MsgId,
+		Msg:     entry.MsgData,
+		PrevSeq: prevSeq,
+	}
+	msgData, err := this.Marshal(RELIABLE_PUSH_MSG_ID, push)
+	if err != nil {
+		log.Error("marshal push error: %v", err)
+		return
+	}
+	this.send(clientId, RELIABLE_PUSH_MSG_ID, push, msgData)
+}
+
+// on the server, frame is the whole frame with msgId
+func (this *PBProcessor) routePushAck(clientId uint64, frame []byte) {
+	if this.reliable == nil {
+		return
+	}
+	playerId, ok := this.reliable.player(clientId)
+	if !ok {
+		log.Warn("push ack before login, clientId: %v", clientId)
+		return
+	}
+
+	ack := &pb.PushAck{}
+	if err := proto.Unmarshal(frame[utils2.MSG_ID_LEN:], ack); err != nil {
+		log.Warn("invalid push ack, clientId: %v, err: %v", clientId, err)
+		this.onBadFrame(clientId, BAD_FRAME_UNMARSHAL, PUSH_ACK_MSG_ID, frame, false)
+		return
+	}
+	if err := this.reliable.store.Ack(playerId, ack.Seq); err != nil {
+		log.Error("ack push error, playerId: %v, err: %v", playerId, err)
+	}
+}
+
+// on the client, the msg is routed as if it came alone, once per seq and in
+// the order the server sent it, then the last push handled in order is acked
+// through the sender. a push whose msg is dropped, without a handler or
+// invalid, is logged and skipped so it does not hold back the ones after it
+func (this *PBProcessor) routeReliablePush(clientId uint64, frame []byte) {
+	push := &pb.ReliablePush{}
+	if err := proto.Unmarshal(frame[utils2.MSG_ID_LEN:], push); err != nil {
+		log.Warn("invalid push: %v", err)
+		this.onBadFrame(clientId, BAD_FRAME_UNMARSHAL, RELIABLE_PUSH_MSG_ID, frame, false)
+		return
+	}
+
+	next := push
+	this.clients.update(clientId, func(state *clientState) {
+		if push.Seq <= state.pushSeq {
+			next = nil
+		} else if push.PrevSeq > state.pushSeq {
+			log.Debug("push seq: %v before seq: %v, clientId: %v", push.Seq, push.PrevSeq, clientId)
+			if state.earlyPushes == nil {
+				state.earlyPushes = make(map[uint64]*pb.ReliablePush)
+			}
+			if len(state.earlyPushes) < MAX_EARLY_PUSHES {
+				state.earlyPushes[push.PrevSeq] = push
+			} else {
+				log.Warn("drop push seq: %v, too many early pushes, clientId: %v", push.Seq, clientId)
+			}
+			next = nil
+		}
+	})
+
+	for next != nil {
+		msgFrame := make([]byte, utils2.MSG_ID_LEN+len(next.Msg))
+		utils.PutUint32ToByte(msgFrame, next.MsgId, this.littleEndian)
+		copy(msgFrame[utils2.MSG_ID_LEN:], next.Msg)
+		if !this.route(clientId, msgFrame) {
+			log.Error("push seq: %v of msgId: %v dropped, clientId: %v", next.Seq, next.MsgId, clientId)
+		}
+
+		seq := next.Seq
+		this.clients.update(clientId, func(state *clientState) {
+			state.pushSeq = seq
+			next = state.earlyPushes[seq]
+			for prevSeq := range state.earlyPushes {
+				if prevSeq <= seq {
+					delete(state.earlyPushes, prevSeq)
+				}
+			}
+		})
+	}
+
+	state, _ := this.clients.get(clientId)
+	if state.pushSeq == 0 {
+		return
+	}
+	ack := &pb.PushAck{Seq: state.pushSeq}
+	ackData, err := this.Marshal(PUSH_ACK_MSG_ID, ack)
+	if err != nil {
+		log.Error("marshal push ack error: %v", err)
+		return
+	}
+	this.send(clientId, PUSH_ACK_MSG_ID, ack, ackData)
+}
@@ -0,0 +1,265 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	"gameserver/core/processor/pb"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+	"time"
+)
+
+// ---------------------
+// | msgId | seq | msg |
+// ---------------------
+// frame of request and response msgs, seq is chosen by the client and
+// echoed back in the response
+
+// reserved msgIds
+const (
+	ERROR_RESP_MSG_ID = 0xFFFFFF00 + iota
+	HANDSHAKE_REQ_MSG_ID
+	HANDSHAKE_RESP_MSG_ID
+	BATCH_MSG_ID
+	RELIABLE_PUSH_MSG_ID
+	PUSH_ACK_MSG_ID
+	CLIENT_CLOSED_MSG_ID
+	// ErrorResp to a msg that is not a request, without seq
+	ERROR_MSG_ID
+)
+
+// codes of ErrorResp
+const (
+	ERROR_CODE_INTERNAL = 1 + iota
+	ERROR_CODE_BAD_REQUEST
+	ERROR_CODE_UNSUPPORTED_VERSION
+	ERROR_CODE_INVALID_MSG
+	ERROR_CODE_UNKNOWN_MSG
+)
+
+type RequestHandler func(clientId uint64, msg proto.Message) (proto.Message, error)
+
+// send a frame to a client, set by the owner of the connections
+type Sender func(clientId uint64, msgData []byte) error
+
+// the error a request handler returns to reply a code to the client, other
+// errors are logged and replied as ERROR_CODE_INTERNAL
+type CodeError struct {
+	Code int32
+	Msg  string
+}
+
+func NewCodeError(code int32, msg string) *CodeError {
+	return &CodeError{Code: code, Msg: msg}
+}
+
+func (this *CodeError) Error() string {
+	return fmt.Sprintf("code %d: %s", this.Code, this.Msg)
+}
+
+func (this *PBProcessor) SetSender(sender Sender) {
+	this.sender = sender
+}
+
+// every frame to a client goes through here to be traced, msg is nil for a
+// frame sent again
+func (this *PBProcessor) send(clientId uint64, msgId uint32, msg proto.Message, msgData []byte) error {
+	start := time.Now()
+	sender, err := this.senderOf(clientId)
+	if err != nil {
+		log.Warn("drop msg: %v", err)
+		return err
+	}
+	if err = sender(msgData); err != nil {
+		log.Debug("send to clientId %v error: %v", clientId, err)
+	}
+	this.traceOut(clientId, msgId, msg, len(msgData), start)
+	return err
+}
+
+// the reply of handler is sent back as respId with the seq of the request
+func (this *PBProcessor) RegisterRequest(msgId uint32, msg proto.Message, respId uint32, resp proto.Message, handler RequestHandler) {
+	checkHandler(msgId, handler != nil)
+	this.checkDuplicate(msgId, messageName(msg))
+	this.msgInfoList[msgId] = &MessageInfo{
+		msgType:    reflect.TypeOf(msg),
+		reqHandler: handler,
+		respId:     respId,
+	}
+	this.respTypeList[respId] = reflect.TypeOf(resp)
+	this.rebuildHandler(msgId)
+	this.loadRules(msgId)
+}
+
+// the end of the interceptor chain of a request
+func replyHandler(reqHandler RequestHandler) CallHandler {
+	return func(call *Call, msg proto.Message) {
+		resp, err := reqHandler(call.ClientId, msg)
+		call.replyResp(resp, err)
+	}
+}
+
+// run the wrapped handler, return the frame replied
+func (this *PBProcessor) handleRequest(clientId uint64, msgId uint32, msgInfo *MessageInfo, msg proto.Message, seq uint32) []byte {
+	call := &Call{ClientId: clientId, MsgId: msgId, Request: true, Seq: seq, processor: this}
+	msgInfo.handler(call, msg)
+	return call.reply
+}
+
+// on the client, the type UnmarshalResponse decodes respId into
+func (this *PBProcessor) RegisterResponse(respId uint32, resp proto.Message) {
+	this.respTypeList[respId] = reflect.TypeOf(resp)
+}
+
+// frame is the whole frame with msgId
+func (this *PBProcessor) routeRequest(clientId uint64, msgId uint32, msgInfo *MessageInfo, frame []byte) {
+	if len(frame) < utils2.REQUEST_HEAD_LEN {
+		log.Warn("request too short, msgId: %v, clientId: %v, size: %v", msgId, clientId, len(frame))
+		this.onBadFrame(clientId, BAD_FRAME_SHORT, msgId, frame, false)
+		return
+	}
+	msgData := frame[utils2.MSG_ID_LEN:]
+	seq := utils.ByteToUint32(msgData, this.littleEndian)
+
+	key := idempotentKey{clientId: clientId, msgId: msgId, seq: seq}
+	cached, hash, run := this.idempotency.begin(key, msgData[utils2.SEQ_LEN:])
+	if !run {
+		if cached != nil {
+			this.send(clientId, utils.ByteToUint32(cached, this.littleEndian), nil, cached)
+		}
+		return
+	}
+	// also if the handler panics
+	var replied []byte
+	defer func() {
+		this.idempotency.finish(key, hash, replied)
+	}()
+
+	msg, err := this.unmarshal(msgId, msgInfo, msgData[utils2.SEQ_LEN:])
+	if err != nil {
+		replied = this.reply(clientId, msgId, seq, nil, NewCodeError(ERROR_CODE_BAD_REQUEST, "bad request"))
+		this.onBadFrame(clientId, BAD_FRAME_UNMARSHAL, msgId, frame, true)
+		return
+	}
+	if err := this.validate(clientId, msgId, msg); err != nil {
+		replied = this.reply(clientId, msgId, seq, nil, validationCodeError(err))
+		msgInfo.release(msg)
+		return
+	}
+
+	text, traced := this.traceText(clientId, msgId, msg)
+	start := time.Now()
+	replied = this.handleRequest(clientId, msgId, msgInfo, msg, seq)
+	cost := time.Since(start)
+	this.Metrics().addLatency(msgId, cost)
+	if traced {
+		this.tracer.trace(TRACE_IN, clientId, msgId, utils2.MSG_ID_LEN+len(msgData), cost, text)
+	}
+	// the reply is marshaled before the handler returns
+	msgInfo.release(msg)
+}
+
+// return the frame sent, nil if none
+func (this *PBProcessor) reply(clientId uint64, msgId uint32, seq uint32, resp proto.Message, err error) []byte {
+	respId := this.msgInfoList[msgId].respId
+	if err != nil {
+		var codeErr *CodeError
+		if !errors.As(err, &codeErr) {
+			log.Error("request error, clientId: %v, msgId: %v, err: %v", clientId, msgId, err)
+			codeErr = NewCodeError(ERROR_CODE_INTERNAL, "internal error")
+		}
+		respId = ERROR_RESP_MSG_ID
+		resp = &pb.ErrorResp{
+			ReqMsgId: msgId,
+			Code:     codeErr.Code,
+			Message:  codeErr.Msg,
+		}
+	} else if resp == nil {
+		return nil
+	}
+
+	msgData, err := this.MarshalResponse(respId, seq, resp)
+	if err != nil {
+		log.Error("marshal response error, msgId: %v, err: %v", msgId, err)
+		return nil
+	}
+	this.send(clientId, respId, resp, msgData)
+	return msgData
+}
+
+func (this *PBProcessor) marshalWithSeq(msgId uint32, seq uint32, msg proto.Message) ([]byte, error) {
+	msgData, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(msgData)+utils2.REQUEST_HEAD_LEN)
+	utils.PutUint32ToByte(buf, msgId, this.littleEndian)
+	utils.PutUint32ToByte(buf[utils2.MSG_ID_LEN:], seq, this.littleEndian)
+	copy(buf[utils2.REQUEST_HEAD_LEN:], msgData)
+	this.Metrics().addOut(msgId, len(buf))
+
+	return buf, nil
+}
+
+// add head: msgId + seq, used by clients
+func (this *PBProcessor) MarshalRequest(msgId uint32, seq uint32, msg proto.Message) ([]byte, error) {
+	return this.marshalWithSeq(msgId, seq, msg)
+}
+
+// MarshalRequest and send it through the sender, used by clients
+func (this *PBProcessor) SendRequest(clientId uint64, msgId uint32, seq uint32, msg proto.Message) error {
+	msgData, err := this.MarshalRequest(msgId, seq, msg)
+	if err != nil {
+		return err
+	}
+	return this.send(clientId, msgId, msg, msgData)
+}
+
+// add head: respId + seq
+func (this *PBProcessor) MarshalResponse(respId uint32, seq uint32, msg proto.Message) ([]byte, error) {
+	return this.marshalWithSeq(respId, seq, msg)
+}
+
+func (this *PBProcessor) IsResponse(msgId uint32) bool {
+	_, ok := this.respTypeList[msgId]
+	return ok
+}
+
+// decode a response frame, err is a *CodeError if the server replied ErrorResp
+func (this *PBProcessor) UnmarshalResponse(msgData []byte) (uint32, uint32, proto.Message, error) {
+	if len(msgData) < utils2.REQUEST_HEAD_LEN {
+		return 0, 0, nil, errors.New("response too short")
+	}
+	msgId := utils.ByteToUint32(msgData, this.littleEndian)
+	seq := utils.ByteToUint32(msgData[utils2.MSG_ID_LEN:], this.littleEndian)
+
+	msgType, ok := this.respTypeList[msgId]
+	if !ok {
+		return msgId, seq, nil, fmt.Errorf("response msgId not found: %v", msgId)
+	}
+
+	msg := reflect.New(msgType.Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(msgData[utils2.REQUEST_HEAD_LEN:], msg); err != nil {
+		return msgId, seq, nil, err
+	}
+
+	if errResp, ok := msg.(*pb.ErrorResp); ok && msgId == ERROR_RESP_MSG_ID {
+		return msgId, seq, msg, NewCodeError(errResp.Code, errResp.Message)
+	}
+
+	return msgId, seq, msg, nil
+}
+
+// marshal msg and send it to the client through the sender, or through its
+// gateway if it was routed by RouteServerMsg
+func (this *PBProcessor) Send(clientId uint64, msgId uint32, msg proto.Message) error {
+	msgData, err := this.Marshal(msgId, msg)
+	if err != nil {
+		return err
+	}
+	return this.send(clientId, msgId, msg, msgData)
+}
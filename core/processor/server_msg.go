@@ -0,0 +1,133 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	utils2 "gameserver/core/utils"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+// ---------------------------
+// | clientId | msgId | msg |
+// ---------------------------
+// frame between a gateway and the servers behind it, clientId is the player
+// the msg comes from or goes to, the rest is the frame of the player
+
+var ErrServerMsgTooShort = errors.New("server msg too short")
+
+// send a frame to a gateway, serverId is what RouteServerMsg was called with
+func (this *PBProcessor) SetServerSender(sender Sender) {
+	this.serverSender = sender
+}
+
+// route a frame forwarded by the gateway serverId, handlers receive the
+// clientId of the player and replies to it go back through the gateway. the
+// frame of MarshalClientClosed removes the client
+func (this *PBProcessor) RouteServerMsg(serverId uint64, msgData []byte) {
+	if len(msgData) < utils2.SERVER_MSG_HEAD_LEN {
+		log.Warn("server msg too short, serverId: %v", serverId)
+		return
+	}
+	clientId := utils.ByteToUint64(msgData, this.littleEndian)
+	if utils.ByteToUint32(msgData[utils2.CLIENT_ID_LEN:], this.littleEndian) == CLIENT_CLOSED_MSG_ID {
+		this.RemoveClient(clientId)
+		return
+	}
+
+	this.clients.update(clientId, func(state *clientState) {
+		state.gatewayId = serverId
+		state.viaGateway = true
+	})
+	this.Route(clientId, msgData[utils2.CLIENT_ID_LEN:])
+}
+
+func (this *PBProcessor) UnmarshalServerMsg(msgData []byte) (uint64, uint32, proto.Message, error) {
+	if len(msgData) < utils2.SERVER_MSG_HEAD_LEN {
+		return 0, 0, nil, ErrServerMsgTooShort
+	}
+	clientId := utils.ByteToUint64(msgData, this.littleEndian)
+	msgId := utils.ByteToUint32(msgData[utils2.CLIENT_ID_LEN:], this.littleEndian)
+
+	msg, err := this.Unmarshal(msgId, msgData[utils2.SERVER_MSG_HEAD_LEN:])
+	return clientId, msgId, msg, err
+}
+
+// add head: clientId, to a frame made by Marshal and friends
+func (this *PBProcessor) WrapServerMsg(clientId uint64, msgData []byte) []byte {
+	buf := make([]byte, len(msgData)+utils2.CLIENT_ID_LEN)
+	utils.PutUint64ToByte(buf, clientId, this.littleEndian)
+	copy(buf[utils2.CLIENT_ID_LEN:], msgData)
+
+	return buf
+}
+
+// on the gateway: the frame telling the servers behind it that clientId
+// disconnected, send it to each server the player was routed to
+func (this *PBProcessor) MarshalClientClosed(clientId uint64) []byte {
+	buf := make([]byte, utils2.SERVER_MSG_HEAD_LEN)
+	utils.PutUint64ToByte(buf, clientId, this.littleEndian)
+	utils.PutUint32ToByte(buf[utils2.CLIENT_ID_LEN:], CLIENT_CLOSED_MSG_ID, this.littleEndian)
+
+	return buf
+}
+
+// push msg to a player of the gateway serverId
+func (this *PBProcessor) SendToPlayer(serverId uint64, clientId uint64, msgId uint32, msg proto.Message) error {
+	if this.serverSender == nil {
+		return errors.New("no server sender")
+	}
+
+	start := time.Now()
+	msgData, err := this.MarshalServerMsg(msgId, clientId, msg)
+	if err != nil {
+		return err
+	}
+
+	err = this.serverSender(serverId, msgData)
+	this.traceOut(clientId, msgId, msg, len(msgData), start)
+	return err
+}
+
+// the gateway a player was last routed from by RouteServerMsg
+func (this *PBProcessor) ClientGateway(clientId uint64) (uint64, bool) {
+	state, ok := this.clients.get(clientId)
+	if !ok || !state.viaGateway {
+		return 0, false
+	}
+	return state.gatewayId, true
+}
+
+// the sender for clientId, through its gateway if it has one
+func (this *PBProcessor) senderOf(clientId uint64) (func(msgData []byte) error, error) {
+	if this.serverSender != nil {
+		if serverId, ok := this.ClientGateway(clientId); ok {
+			return func(msgData []byte) error {
+				return this.serverSender(serverId, this.WrapServerMsg(clientId, msgData))
+			}, nil
+		}
+	}
+
+	if this.sender == nil {
+		return nil, fmt.Errorf("no sender to clientId: %v", clientId)
+	}
+	return func(msgData []byte) error {
+		return this.sender(clientId, msgData)
+	}, nil
+}
+
+// on the gateway: strip the head of a frame from a server and send the rest
+// to the player through the sender
+func (this *PBProcessor) ForwardToClient(msgData []byte) error {
+	if len(msgData) < utils2.SERVER_MSG_HEAD_LEN {
+		return ErrServerMsgTooShort
+	}
+	if this.sender == nil {
+		return errors.New("no sender")
+	}
+	clientId := utils.ByteToUint64(msgData, this.littleEndian)
+
+	return this.sender(clientId, msgData[utils2.CLIENT_ID_LEN:])
+}
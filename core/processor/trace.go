@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"gameserver/core/log"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REDACTED = "***"
+
+// directions of a traced msg
+const (
+	TRACE_IN  = "in"
+	TRACE_OUT = "out"
+)
+
+// fields redacted unless Redact is called
+var DefaultRedactFields = []string{"password", "passwd", "token", "secret", "session_key"}
+
+// logs the msgs of the traced clients and msgIds in prototext, goroutine safe
+// so it can be switched on and off while serving
+type Tracer struct {
+	sync.RWMutex
+	all     bool
+	clients map[uint64]bool
+	msgIds  map[uint32]bool
+
+	// field names, or full names like game.LoginReq.token
+	redact map[string]bool
+}
+
+func NewTracer() *Tracer {
+	tracer := &Tracer{
+		clients: make(map[uint64]bool),
+		msgIds:  make(map[uint32]bool),
+	}
+	tracer.Redact(DefaultRedactFields...)
+	return tracer
+}
+
+func (this *Tracer) TraceAll(on bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.all = on
+}
+
+func (this *Tracer) TraceClient(clientId uint64, on bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	if on {
+		this.clients[clientId] = true
+	} else {
+		delete(this.clients, clientId)
+	}
+}
+
+func (this *Tracer) TraceMsg(msgId uint32, on bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	if on {
+		this.msgIds[msgId] = true
+	} else {
+		delete(this.msgIds, msgId)
+	}
+}
+
+// replace the redaction rules, names are matched case insensitively
+func (this *Tracer) Redact(fields ...string) {
+	redact := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		redact[strings.ToLower(field)] = true
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.redact = redact
+}
+
+func (this *Tracer) Enabled(clientId uint64, msgId uint32) bool {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.all || this.clients[clientId] || this.msgIds[msgId]
+}
+
+func (this *Tracer) redacted(fd protoreflect.FieldDescriptor) bool {
+	return this.redact[strings.ToLower(string(fd.Name()))] || this.redact[strings.ToLower(string(fd.FullName()))]
+}
+
+// the redacted msg in one line of prototext
+func (this *Tracer) Format(msg proto.Message) string {
+	if msg == nil {
+		return "<nil>"
+	}
+
+	this.RLock()
+	defer this.RUnlock()
+
+	m := proto.MessageV2(proto.Clone(msg)).ProtoReflect()
+	this.redactMessage(m)
+	return prototext.MarshalOptions{}.Format(m.Interface())
+}
+
+func (this *Tracer) redactMessage(msg protoreflect.Message) {
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if this.redacted(fd) {
+			switch {
+			case fd.IsList() || fd.IsMap():
+				msg.Clear(fd)
+			case fd.Kind() == protoreflect.StringKind:
+				msg.Set(fd, protoreflect.ValueOfString(REDACTED))
+			case fd.Kind() == protoreflect.BytesKind:
+				msg.Set(fd, protoreflect.ValueOfBytes([]byte(REDACTED)))
+			default:
+				msg.Clear(fd)
+			}
+			return true
+		}
+
+		if fd.Message() == nil {
+			return true
+		}
+		if fd.IsMap() {
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				this.redactMessage(value.Message())
+				return true
+			})
+		} else if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				this.redactMessage(list.Get(i).Message())
+			}
+		} else {
+			this.redactMessage(v.Message())
+		}
+		return true
+	})
+}
+
+func (this *Tracer) trace(dir string, clientId uint64, msgId uint32, size int, cost time.Duration, text string) {
+	log.Info("trace %v, clientId: %v, msgId: %v, size: %v, cost: %v, msg: {%v}", dir, clientId, msgId, size, cost, text)
+}
+
+//********************************************************
+// processor
+//********************************************************
+
+func (this *PBProcessor) Tracer() *Tracer {
+	return this.tracer
+}
+
+// the text of an inbound msg if it is traced, taken before the handler runs
+// since a pooled msg is reset after it
+func (this *PBProcessor) traceText(clientId uint64, msgId uint32, msg proto.Message) (string, bool) {
+	if !this.tracer.Enabled(clientId, msgId) {
+		return "", false
+	}
+	return this.tracer.Format(msg), true
+}
+
+func (this *PBProcessor) traceOut(clientId uint64, msgId uint32, msg proto.Message, size int, start time.Time) {
+	if this.tracer.Enabled(clientId, msgId) {
+		this.tracer.trace(TRACE_OUT, clientId, msgId, size, time.Since(start), this.tracer.Format(msg))
+	}
+}
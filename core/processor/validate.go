@@ -0,0 +1,369 @@
+package processor
+
+import (
+	"fmt"
+	"gameserver/core/log"
+	"gameserver/core/processor/pb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// checks a msg after Unmarshal, a *CodeError is replied as is, other errors,
+// *ValidationError included, as ERROR_CODE_INVALID_MSG with their text
+type Validator func(clientId uint64, msg proto.Message) error
+
+type ValidationConfig struct {
+	// do not reply ErrorResp to invalid msgs that are not requests
+	NoReply bool
+
+	// called with the number of invalid msgs of the client so far, the
+	// owner of the connection can kick the client
+	OnViolation func(clientId uint64, msgId uint32, violations int64, err error)
+}
+
+type ValidationError struct {
+	Field string
+	Rule  string
+	Msg   string
+}
+
+func (this *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", this.Field, this.Msg)
+}
+
+// the rules of a field read from its (core.xxx) options
+type fieldRule struct {
+	fd       protoreflect.FieldDescriptor
+	required bool
+	minLen   *uint32
+	maxLen   *uint32
+	min      *float64
+	max      *float64
+	maxItems *uint32
+	pattern  *regexp.Regexp
+}
+
+type validation struct {
+	config *ValidationConfig
+
+	sync.Mutex
+	rules map[protoreflect.FullName][]*fieldRule
+}
+
+// run the field rules and the validators after Unmarshal in Route
+func (this *PBProcessor) EnableValidation(config *ValidationConfig) {
+	if config == nil {
+		config = &ValidationConfig{}
+	}
+
+	this.validation = &validation{
+		config: config,
+		rules:  make(map[protoreflect.FullName][]*fieldRule),
+	}
+	for msgId := range this.msgInfoList {
+		this.loadRules(msgId)
+	}
+}
+
+// read the rules of the msgs of msgId and of the msgs in their fields when
+// it is registered, so an invalid rule stops the server at startup instead of
+// at the first msg
+func (this *PBProcessor) loadRules(msgId uint32) {
+	if this.validation == nil {
+		return
+	}
+
+	msgInfo := this.msgInfoList[msgId]
+	for _, info := range append([]*MessageInfo{msgInfo}, msgInfo.versions...) {
+		if !info.hasType() {
+			continue
+		}
+		if err := this.validation.load(info.descriptor()); err != nil {
+			log.Fatal("invalid rules of msgId: %v, %v", msgId, err)
+		}
+	}
+}
+
+// run after the field rules, once EnableValidation is called
+func (this *PBProcessor) RegisterValidator(msgId uint32, validator Validator) {
+	this.validators[msgId] = append(this.validators[msgId], validator)
+}
+
+// invalid msgs of the client since it connected
+func (this *PBProcessor) ClientViolations(clientId uint64) int64 {
+	state, _ := this.clients.get(clientId)
+	return state.violations
+}
+
+// nil if the msg can be handled
+func (this *PBProcessor) validate(clientId uint64, msgId uint32, msg proto.Message) error {
+	if this.validation == nil {
+		return nil
+	}
+
+	err := this.validation.check(proto.MessageV2(msg).ProtoReflect(), "")
+	if err == nil {
+		for _, validator := range this.validators[msgId] {
+			if err = validator(clientId, msg); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	var violations int64
+	this.clients.update(clientId, func(state *clientState) {
+		state.violations++
+		violations = state.violations
+	})
+	log.Debug("invalid msgId: %v, clientId: %v, err: %v", msgId, clientId, err)
+	if onViolation := this.validation.config.OnViolation; onViolation != nil {
+		onViolation(clientId, msgId, violations, err)
+	}
+
+	return err
+}
+
+// reply ErrorResp without seq to an invalid msg that is not a request
+func (this *PBProcessor) rejectMsg(clientId uint64, msgId uint32, err error) {
+	if this.validation.config.NoReply {
+		return
+	}
+
+	this.sendError(clientId, msgId, validationCodeError(err))
+}
+
+func validationCodeError(err error) *CodeError {
+	if codeErr, ok := err.(*CodeError); ok {
+		return codeErr
+	}
+	return NewCodeError(ERROR_CODE_INVALID_MSG, err.Error())
+}
+
+func getExtension(opts *descriptorpb.FieldOptions, xt *protoimpl.ExtensionInfo) (interface{}, bool) {
+	if !proto.HasExtension(opts, xt) {
+		return nil, false
+	}
+	value, err := proto.GetExtension(opts, xt)
+	return value, err == nil
+}
+
+// the rules are loaded at registration, a msg reached otherwise, in a
+// google.protobuf.Any for example, is loaded here with its invalid rules
+// skipped
+func (this *validation) rulesOf(msgDesc protoreflect.MessageDescriptor) []*fieldRule {
+	this.Lock()
+	defer this.Unlock()
+
+	if rules, ok := this.rules[msgDesc.FullName()]; ok {
+		return rules
+	}
+
+	rules, err := buildRules(msgDesc)
+	if err != nil {
+		log.Error("skip invalid rules: %v", err)
+	}
+	this.rules[msgDesc.FullName()] = rules
+
+	return rules
+}
+
+func (this *validation) load(msgDesc protoreflect.MessageDescriptor) error {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.loadLocked(msgDesc)
+}
+
+func (this *validation) loadLocked(msgDesc protoreflect.MessageDescriptor) error {
+	if _, ok := this.rules[msgDesc.FullName()]; ok {
+		return nil
+	}
+
+	rules, err := buildRules(msgDesc)
+	if err != nil {
+		return err
+	}
+	// set before the fields, msgs may contain themselves
+	this.rules[msgDesc.FullName()] = rules
+
+	fields := msgDesc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.IsMap() {
+			continue
+		}
+		if fieldDesc := fd.Message(); fieldDesc != nil {
+			if err := this.loadLocked(fieldDesc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// the patterns are compiled and checked here
+func buildRules(msgDesc protoreflect.MessageDescriptor) ([]*fieldRule, error) {
+	var rules []*fieldRule
+	var invalid error
+	fields := msgDesc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+		if !ok || opts == nil {
+			continue
+		}
+
+		rule := &fieldRule{fd: fd}
+		if value, ok := getExtension(opts, pb.E_Required); ok {
+			rule.required = *value.(*bool)
+		}
+		if value, ok := getExtension(opts, pb.E_MinLen); ok {
+			rule.minLen = value.(*uint32)
+		}
+		if value, ok := getExtension(opts, pb.E_MaxLen); ok {
+			rule.maxLen = value.(*uint32)
+		}
+		if value, ok := getExtension(opts, pb.E_Min); ok {
+			rule.min = value.(*float64)
+		}
+		if value, ok := getExtension(opts, pb.E_Max); ok {
+			rule.max = value.(*float64)
+		}
+		if value, ok := getExtension(opts, pb.E_MaxItems); ok {
+			rule.maxItems = value.(*uint32)
+		}
+		if value, ok := getExtension(opts, pb.E_Pattern); ok {
+			pattern, err := regexp.Compile(*value.(*string))
+			if err != nil && invalid == nil {
+				invalid = fmt.Errorf("invalid pattern of %v: %v", fd.FullName(), err)
+			}
+			rule.pattern = pattern
+		}
+
+		if rule.required || rule.minLen != nil || rule.maxLen != nil || rule.min != nil ||
+			rule.max != nil || rule.maxItems != nil || rule.pattern != nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, invalid
+}
+
+// check the rules of msg and of the msgs in its fields
+func (this *validation) check(msg protoreflect.Message, path string) error {
+	for _, rule := range this.rulesOf(msg.Descriptor()) {
+		if err := rule.check(msg, path+string(rule.fd.Name())); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind || fd.IsMap() {
+			return true
+		}
+
+		name := path + string(fd.Name())
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len() && err == nil; i++ {
+				err = this.check(list.Get(i).Message(), fmt.Sprintf("%v[%v].", name, i))
+			}
+		} else {
+			err = this.check(v.Message(), name+".")
+		}
+		return err == nil
+	})
+
+	return err
+}
+
+func (this *fieldRule) check(msg protoreflect.Message, name string) error {
+	fd := this.fd
+	if !msg.Has(fd) {
+		if this.required {
+			return &ValidationError{Field: name, Rule: "required", Msg: "is required"}
+		}
+		if fd.IsList() || fd.IsMap() || fd.Message() != nil {
+			return nil
+		}
+		// a zero scalar is not on the wire but must be in range too
+		return this.checkValue(fd.Default(), name)
+	}
+
+	v := msg.Get(fd)
+	switch {
+	case fd.IsList():
+		list := v.List()
+		if this.maxItems != nil && uint32(list.Len()) > *this.maxItems {
+			return &ValidationError{Field: name, Rule: "max_items", Msg: fmt.Sprintf("more than %v items", *this.maxItems)}
+		}
+		for i := 0; i < list.Len(); i++ {
+			if err := this.checkValue(list.Get(i), fmt.Sprintf("%v[%v]", name, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fd.IsMap():
+		if this.maxItems != nil && uint32(v.Map().Len()) > *this.maxItems {
+			return &ValidationError{Field: name, Rule: "max_items", Msg: fmt.Sprintf("more than %v items", *this.maxItems)}
+		}
+		return nil
+	}
+
+	return this.checkValue(v, name)
+}
+
+func (this *fieldRule) checkValue(v protoreflect.Value, name string) error {
+	var length int
+	var number float64
+	isLen, isNumber := false, false
+
+	switch this.fd.Kind() {
+	case protoreflect.StringKind:
+		s := v.String()
+		if this.pattern != nil && !this.pattern.MatchString(s) {
+			return &ValidationError{Field: name, Rule: "pattern", Msg: "does not match " + this.pattern.String()}
+		}
+		length, isLen = utf8.RuneCountInString(s), true
+	case protoreflect.BytesKind:
+		length, isLen = len(v.Bytes()), true
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		number, isNumber = float64(v.Int()), true
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		number, isNumber = float64(v.Uint()), true
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		number, isNumber = v.Float(), true
+	case protoreflect.EnumKind:
+		number, isNumber = float64(v.Enum()), true
+	}
+
+	if isLen {
+		if this.minLen != nil && uint32(length) < *this.minLen {
+			return &ValidationError{Field: name, Rule: "min_len", Msg: fmt.Sprintf("shorter than %v", *this.minLen)}
+		}
+		if this.maxLen != nil && uint32(length) > *this.maxLen {
+			return &ValidationError{Field: name, Rule: "max_len", Msg: fmt.Sprintf("longer than %v", *this.maxLen)}
+		}
+	}
+	if isNumber {
+		if this.min != nil && number < *this.min {
+			return &ValidationError{Field: name, Rule: "min", Msg: fmt.Sprintf("less than %v", *this.min)}
+		}
+		if this.max != nil && number > *this.max {
+			return &ValidationError{Field: name, Rule: "max", Msg: fmt.Sprintf("greater than %v", *this.max)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"gameserver/common/utils"
+	"gameserver/core/log"
+	"gameserver/core/processor"
+	utils2 "gameserver/core/utils"
+	"sort"
+)
+
+// implemented by PBProcessor and JSONProcessor, used to report msgIds
+// without a route at startup
+type msgIdLister interface {
+	MsgIds() []uint32
+}
+
+// [from, to]
+type msgRange struct {
+	from    uint32
+	to      uint32
+	service *Service
+}
+
+// enqueues each msg to the service owning its msgId, an explicit msgId wins
+// over a range, a range over the default route. the services are not safe
+// to share state, a client may talk to several of them at once, except the
+// client states of the PBProcessors, see Start
+type Dispatcher struct {
+	services       map[string]*Service
+	msgIds         map[uint32]*Service
+	ranges         []*msgRange
+	defaultService *Service
+
+	littleEndian bool
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		services:     make(map[string]*Service),
+		msgIds:       make(map[uint32]*Service),
+		littleEndian: true,
+	}
+}
+
+func (this *Dispatcher) SetByteOrder(littleEndian bool) {
+	this.littleEndian = littleEndian
+}
+
+func (this *Dispatcher) AddService(service *Service) {
+	if _, ok := this.services[service.Name()]; ok {
+		log.Fatal("service %v added twice", service.Name())
+	}
+	this.services[service.Name()] = service
+}
+
+func (this *Dispatcher) service(name string) *Service {
+	service, ok := this.services[name]
+	if !ok {
+		log.Fatal("service not found: %v", name)
+	}
+	return service
+}
+
+func (this *Dispatcher) RouteIds(name string, msgIds ...uint32) {
+	service := this.service(name)
+	for _, msgId := range msgIds {
+		if old, ok := this.msgIds[msgId]; ok {
+			log.Fatal("msgId: %v routed to %v and %v", msgId, old.Name(), name)
+		}
+		this.msgIds[msgId] = service
+	}
+}
+
+// route msgIds in [from, to], ranges must not overlap
+func (this *Dispatcher) RouteRange(from uint32, to uint32, name string) {
+	if from > to {
+		log.Fatal("invalid msgId range: [%v, %v]", from, to)
+	}
+	service := this.service(name)
+	for _, r := range this.ranges {
+		if from <= r.to && r.from <= to {
+			log.Fatal("msgId range [%v, %v] of %v overlaps [%v, %v] of %v",
+				from, to, name, r.from, r.to, r.service.Name())
+		}
+	}
+
+	this.ranges = append(this.ranges, &msgRange{from: from, to: to, service: service})
+	sort.Slice(this.ranges, func(i, j int) bool { return this.ranges[i].from < this.ranges[j].from })
+}
+
+// the service of msgIds without a route, the reserved msgIds of the
+// processors like the handshake are routed here as well
+func (this *Dispatcher) SetDefault(name string) {
+	this.defaultService = this.service(name)
+}
+
+// nil if msgId has no route
+func (this *Dispatcher) ServiceOf(msgId uint32) *Service {
+	if service, ok := this.msgIds[msgId]; ok {
+		return service
+	}
+
+	i := sort.Search(len(this.ranges), func(i int) bool { return this.ranges[i].to >= msgId })
+	if i < len(this.ranges) && this.ranges[i].from <= msgId {
+		return this.ranges[i].service
+	}
+
+	return this.defaultService
+}
+
+// the PBProcessor of the default service, nil if it has another processor
+func (this *Dispatcher) defaultProcessor() *processor.PBProcessor {
+	if this.defaultService == nil {
+		return nil
+	}
+	p, _ := this.defaultService.Processor().(*processor.PBProcessor)
+	return p
+}
+
+func (this *Dispatcher) badFrame(clientId uint64, kind int, msgId uint32, msgData []byte) {
+	if p := this.defaultProcessor(); p != nil {
+		p.ReportBadFrame(clientId, kind, msgId, msgData)
+	}
+}
+
+// the Route of the network side, a batch is split so each msg goes to its
+// own service. a handshake is handled by the processor of the default
+// service right away on the calling goroutine, so the msgs after it see it
+// whichever service they go to
+func (this *Dispatcher) Route(clientId uint64, msgData []byte) {
+	if len(msgData) < utils2.MSG_ID_LEN {
+		log.Warn("msg too short, clientId: %v", clientId)
+		this.badFrame(clientId, processor.BAD_FRAME_SHORT, 0, msgData)
+		return
+	}
+	msgId := utils.ByteToUint32(msgData, this.littleEndian)
+	switch msgId {
+	case processor.BATCH_MSG_ID:
+		this.routeBatch(clientId, msgData)
+		return
+	case processor.HANDSHAKE_REQ_MSG_ID:
+		if p := this.defaultProcessor(); p != nil {
+			p.Route(clientId, msgData)
+			return
+		}
+	}
+
+	service := this.ServiceOf(msgId)
+	if service == nil {
+		log.Warn("no service of msgId: %v, clientId: %v", msgId, clientId)
+		return
+	}
+	service.Send(clientId, msgData)
+}
+
+// frame is the whole batch with msgId, bad ones get the bad frame policy of
+// the default processor like in PBProcessor
+func (this *Dispatcher) routeBatch(clientId uint64, frame []byte) {
+	msgData := frame[utils2.MSG_ID_LEN:]
+	for len(msgData) > 0 {
+		if len(msgData) < processor.BATCH_ENTRY_LEN {
+			log.Warn("invalid batch, clientId: %v", clientId)
+			this.badFrame(clientId, processor.BAD_FRAME_BATCH, processor.BATCH_MSG_ID, frame)
+			return
+		}
+		entryLen := int(utils.ByteToUint32(msgData, this.littleEndian))
+		msgData = msgData[processor.BATCH_ENTRY_LEN:]
+		if entryLen < utils2.MSG_ID_LEN || entryLen > len(msgData) {
+			log.Warn("invalid batch entry len: %v, clientId: %v", entryLen, clientId)
+			this.badFrame(clientId, processor.BAD_FRAME_BATCH, processor.BATCH_MSG_ID, frame)
+			return
+		}
+
+		entry := msgData[:entryLen]
+		msgData = msgData[entryLen:]
+		if utils.ByteToUint32(entry, this.littleEndian) == processor.BATCH_MSG_ID {
+			log.Warn("nested batch, clientId: %v", clientId)
+			this.badFrame(clientId, processor.BAD_FRAME_BATCH, processor.BATCH_MSG_ID, frame)
+			continue
+		}
+		this.Route(clientId, entry)
+	}
+}
+
+// msgIds registered by a service's processor but routed elsewhere or
+// nowhere, only processors with MsgIds are checked
+func (this *Dispatcher) Unrouted() map[string][]uint32 {
+	result := make(map[string][]uint32)
+	for name, service := range this.services {
+		lister, ok := service.Processor().(msgIdLister)
+		if !ok {
+			continue
+		}
+		for _, msgId := range lister.MsgIds() {
+			if msgId >= processor.ERROR_RESP_MSG_ID {
+				continue
+			}
+			if this.ServiceOf(msgId) != service {
+				result[name] = append(result[name], msgId)
+			}
+		}
+	}
+
+	return result
+}
+
+// report the unrouted msgIds and start the services. the PBProcessors of
+// the services share the client states of the default service, which
+// handles the handshakes, so a client that passed it there passes
+// everywhere. its HandshakeConfig callbacks run on the goroutine of Route
+func (this *Dispatcher) Start() {
+	for name, msgIds := range this.Unrouted() {
+		log.Warn("msgIds of service %v not routed to it: %v", name, msgIds)
+	}
+
+	if shared := this.defaultProcessor(); shared != nil {
+		for _, service := range this.services {
+			if p, ok := service.Processor().(*processor.PBProcessor); ok && p != shared {
+				p.ShareClients(shared)
+			}
+		}
+	}
+
+	for _, service := range this.services {
+		service.Start()
+	}
+}
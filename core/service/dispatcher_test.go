@@ -0,0 +1,90 @@
+package service
+
+import (
+	"gameserver/core/log"
+	"gameserver/core/processor"
+	"gameserver/core/processor/pb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"os"
+	"testing"
+)
+
+func init() {
+	log.InitLog(os.TempDir(), "error", false, 0)
+}
+
+func ignoreMsg(clientId uint64, msg proto.Message) {}
+
+func TestDispatcher(t *testing.T) {
+	login := processor.NewPBProcessor()
+	login.Register(1, &descriptorpb.FileOptions{}, ignoreMsg)
+	chat := processor.NewPBProcessor()
+	chat.Register(1001, &descriptorpb.FileOptions{}, ignoreMsg)
+	chat.Register(3000, &descriptorpb.FileOptions{}, ignoreMsg)
+
+	d := NewDispatcher()
+	d.AddService(NewService("login", login, 10))
+	d.AddService(NewService("chat", chat, 10))
+	d.RouteRange(1000, 1999, "chat")
+	d.RouteIds("login", 1, 1500)
+	d.SetDefault("login")
+
+	for msgId, name := range map[uint32]string{1: "login", 1000: "chat", 1500: "login", 1999: "chat", 2000: "login"} {
+		if service := d.ServiceOf(msgId); service.Name() != name {
+			t.Fatalf("msgId %v routed to %v", msgId, service.Name())
+		}
+	}
+	if unrouted := d.Unrouted(); len(unrouted) != 1 || len(unrouted["chat"]) != 1 || unrouted["chat"][0] != 3000 {
+		t.Fatalf("unrouted %v", unrouted)
+	}
+
+	m1, _ := login.Marshal(1, &descriptorpb.FileOptions{})
+	m2, _ := chat.Marshal(1001, &descriptorpb.FileOptions{JavaPackage: proto.String("hi")})
+	d.Route(7, login.MarshalBatch(m1, m2))
+	if io := <-d.services["login"].callChan; io.ClienId != 7 || len(io.Buff) != len(m1) {
+		t.Fatalf("login got %v", io)
+	}
+	if io := <-d.services["chat"].callChan; io.ClienId != 7 || len(io.Buff) != len(m2) {
+		t.Fatalf("chat got %v", io)
+	}
+
+	d.Route(7, login.MarshalBatch(login.MarshalBatch(m1), m2))
+	if io := <-d.services["chat"].callChan; len(io.Buff) != len(m2) {
+		t.Fatalf("chat got %v", io)
+	}
+	if len(d.services["login"].callChan) != 0 {
+		t.Fatal("nested batch routed")
+	}
+}
+
+func TestDispatcherClientState(t *testing.T) {
+	login := processor.NewPBProcessor()
+	login.EnableHandshake(&processor.HandshakeConfig{MinVersion: 1, MaxVersion: 1, Required: true})
+	login.SetBadFramePolicy(&processor.BadFrameConfig{Batch: &processor.BadFramePolicy{Strikes: 1}})
+	chat := processor.NewPBProcessor()
+	chat.Register(1001, &descriptorpb.FileOptions{}, ignoreMsg)
+
+	d := NewDispatcher()
+	d.AddService(NewService("login", login, 10))
+	d.AddService(NewService("chat", chat, 10))
+	d.RouteRange(1000, 1999, "chat")
+	d.SetDefault("login")
+
+	handshake, _ := login.Marshal(processor.HANDSHAKE_REQ_MSG_ID, &pb.HandshakeReq{Version: 1})
+	d.Route(7, handshake)
+	if version, _, ok := login.ClientVersion(7); !ok || version != 1 {
+		t.Fatalf("handshake not applied: %v %v", version, ok)
+	}
+	if len(d.services["login"].callChan) != 0 {
+		t.Fatal("handshake enqueued")
+	}
+
+	m, _ := chat.Marshal(1001, &descriptorpb.FileOptions{})
+	d.Route(7, login.MarshalBatch(login.MarshalBatch(m)))
+	bad := login.MarshalBatch(m)
+	d.Route(7, bad[:len(bad)-1])
+	if strikes := login.ClientStrikes(7); strikes != 2 {
+		t.Fatalf("strikes %v", strikes)
+	}
+}
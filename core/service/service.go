@@ -17,7 +17,32 @@ type Service struct {
 	callChan chan *CallIO
 	name     string
 
-	processor processor.PBProcessor
+	processor processor.Processor
+}
+
+func NewService(name string, processor processor.Processor, callLen int) *Service {
+	if callLen <= 0 {
+		callLen = 1000
+		log.Info("invalid callLen, reset to %v", callLen)
+	}
+
+	return &Service{
+		callChan:  make(chan *CallIO, callLen),
+		name:      name,
+		processor: processor,
+	}
+}
+
+func (this *Service) Start() {
+	go this.run()
+}
+
+func (this *Service) Name() string {
+	return this.name
+}
+
+func (this *Service) Processor() processor.Processor {
+	return this.processor
 }
 
 func (this *Service) Send(clientId uint64, buff []byte) {
@@ -2,4 +2,6 @@ package utils
 
 const MSG_ID_LEN = 4
 const CLIENT_ID_LEN = 8
-const SERVER_MSG_HEAD_LEN =  MSG_ID_LEN + CLIENT_ID_LEN
\ No newline at end of file
+const SERVER_MSG_HEAD_LEN =  MSG_ID_LEN + CLIENT_ID_LEN
+const SEQ_LEN = 4
+const REQUEST_HEAD_LEN = MSG_ID_LEN + SEQ_LEN
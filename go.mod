@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/golang/protobuf v1.5.2
-	github.com/rs/zerolog v1.21.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/protobuf v1.26.0
 )
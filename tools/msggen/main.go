@@ -0,0 +1,299 @@
+// msggen derives msgIds from a descriptor set and emits typed Register/Send
+// helpers for them.
+//
+//	protoc --include_imports --descriptor_set_out=msg.pb *.proto
+//	//go:generate go run gameserver/tools/msggen -in msg.pb -out msg_gen.go
+//
+// the msgId of a message is read from the (core.msg_id) option, see
+// core/processor/pb/options.proto, or else from an enum named MsgId in the
+// same file with a value named after the message, LOGIN_REQ for LoginReq.
+// XxxReq/XxxResp (or XxxRequest/XxxResponse) pairs get request helpers.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"gameserver/core/processor"
+	"gameserver/core/processor/pb"
+	"go/format"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const msgIdEnum = "MsgId"
+
+type msgDef struct {
+	Name     string
+	FullName string
+	Id       uint32
+	Const    string
+}
+
+type pairDef struct {
+	Base string
+	Req  *msgDef
+	Resp *msgDef
+}
+
+// UPPER_SNAKE of a CamelCase name, LoginReq -> LOGIN_REQ, HTTPReq -> HTTP_REQ
+func upperSnake(name string) string {
+	var buf bytes.Buffer
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				buf.WriteByte('_')
+			}
+		}
+		buf.WriteRune(unicode.ToUpper(r))
+	}
+
+	return buf.String()
+}
+
+// the go name protoc-gen-go gives a top level message
+func goName(name string) string {
+	var buf bytes.Buffer
+	upper := true
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+
+	return buf.String()
+}
+
+func goPackage(file *descriptorpb.FileDescriptorProto) string {
+	goPkg := file.GetOptions().GetGoPackage()
+	if i := strings.Index(goPkg, ";"); i >= 0 {
+		return goPkg[i+1:]
+	}
+	if i := strings.LastIndex(goPkg, "/"); i >= 0 {
+		return goPkg[i+1:]
+	}
+	if goPkg != "" {
+		return goPkg
+	}
+	return strings.Replace(file.GetPackage(), ".", "_", -1)
+}
+
+func skipFile(name string) bool {
+	return strings.HasPrefix(name, "google/protobuf/") || strings.HasSuffix(name, "core/processor/pb/options.proto")
+}
+
+// msgs with a msgId, sorted by id, duplicated ids are an error
+func collect(fds *descriptorpb.FileDescriptorSet, files map[string]bool) ([]*msgDef, error) {
+	var msgs []*msgDef
+	owner := make(map[uint32]*msgDef)
+	var dups []string
+
+	for _, file := range fds.File {
+		if skipFile(file.GetName()) || (len(files) > 0 && !files[file.GetName()]) {
+			continue
+		}
+
+		enumIds := make(map[string]uint32)
+		for _, enum := range file.EnumType {
+			if enum.GetName() != msgIdEnum {
+				continue
+			}
+			for _, value := range enum.Value {
+				enumIds[value.GetName()] = uint32(value.GetNumber())
+			}
+		}
+
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = file.GetPackage() + "."
+		}
+		for _, msgType := range file.MessageType {
+			msg := &msgDef{
+				Name:     goName(msgType.GetName()),
+				FullName: prefix + msgType.GetName(),
+				Const:    upperSnake(msgType.GetName()),
+			}
+
+			opts := msgType.GetOptions()
+			if opts != nil && proto.HasExtension(opts, pb.E_MsgId) {
+				msg.Id = proto.GetExtension(opts, pb.E_MsgId).(uint32)
+			} else if id, ok := enumIds[msg.Const]; ok {
+				msg.Id = id
+			} else {
+				continue
+			}
+
+			if msg.Id == 0 || msg.Id >= processor.ERROR_RESP_MSG_ID {
+				return nil, fmt.Errorf("%v: msgId %v is reserved", msg.FullName, msg.Id)
+			}
+			if other, ok := owner[msg.Id]; ok {
+				dups = append(dups, fmt.Sprintf("msgId %v used by %v and %v", msg.Id, other.FullName, msg.FullName))
+				continue
+			}
+			owner[msg.Id] = msg
+			msg.Const += "_MSG_ID"
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(dups) > 0 {
+		return nil, fmt.Errorf("duplicate msgIds:\n\t%v", strings.Join(dups, "\n\t"))
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Id < msgs[j].Id })
+	return msgs, nil
+}
+
+func pairs(msgs []*msgDef) []*pairDef {
+	byName := make(map[string]*msgDef, len(msgs))
+	for _, msg := range msgs {
+		byName[msg.Name] = msg
+	}
+
+	var result []*pairDef
+	for _, msg := range msgs {
+		for _, suffix := range [][2]string{{"Req", "Resp"}, {"Request", "Response"}} {
+			if !strings.HasSuffix(msg.Name, suffix[0]) {
+				continue
+			}
+			base := strings.TrimSuffix(msg.Name, suffix[0])
+			if resp, ok := byName[base+suffix[1]]; ok {
+				result = append(result, &pairDef{Base: base, Req: msg, Resp: resp})
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+var codeTemplate = template.Must(template.New("code").Parse(`// Code generated by msggen. DO NOT EDIT.
+// source: {{.Source}}
+
+package {{.Package}}
+{{if .Msgs}}
+import (
+	"gameserver/core/processor"
+	"github.com/golang/protobuf/proto"
+)
+{{end}}
+const (
+{{- range .Msgs}}
+	{{.Const}} = {{.Id}}
+{{- end}}
+)
+
+// response msgId of each request msgId
+var ResponseMsgIds = map[uint32]uint32{
+{{- range .Pairs}}
+	{{.Req.Const}}: {{.Resp.Const}},
+{{- end}}
+}
+{{range .Msgs}}
+func Register{{.Name}}(p processor.Processor, handler func(clientId uint64, msg *{{.Name}})) {
+	p.Register({{.Const}}, &{{.Name}}{}, func(clientId uint64, msg proto.Message) {
+		handler(clientId, msg.(*{{.Name}}))
+	})
+}
+
+func Send{{.Name}}(p *processor.PBProcessor, clientId uint64, msg *{{.Name}}) error {
+	return p.Send(clientId, {{.Const}}, msg)
+}
+{{end}}
+{{- range .Pairs}}
+func Register{{.Base}}Request(p *processor.PBProcessor, handler func(clientId uint64, msg *{{.Req.Name}}) (*{{.Resp.Name}}, error)) {
+	p.RegisterRequest({{.Req.Const}}, &{{.Req.Name}}{}, {{.Resp.Const}}, &{{.Resp.Name}}{},
+		func(clientId uint64, msg proto.Message) (proto.Message, error) {
+			resp, err := handler(clientId, msg.(*{{.Req.Name}}))
+			if resp == nil {
+				return nil, err
+			}
+			return resp, err
+		})
+}
+{{end}}`))
+
+func generate(source string, pkg string, msgs []*msgDef) ([]byte, error) {
+	var buf bytes.Buffer
+	err := codeTemplate.Execute(&buf, map[string]interface{}{
+		"Source":  source,
+		"Package": pkg,
+		"Msgs":    msgs,
+		"Pairs":   pairs(msgs),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	in := flag.String("in", "", "descriptor set written by protoc --descriptor_set_out")
+	out := flag.String("out", "msg_gen.go", "output file")
+	pkg := flag.String("pkg", "", "go package name, default from go_package")
+	fileList := flag.String("files", "", "comma separated proto files to read, default all")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, fds); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid descriptor set:", err)
+		os.Exit(1)
+	}
+
+	files := make(map[string]bool)
+	if *fileList != "" {
+		for _, name := range strings.Split(*fileList, ",") {
+			files[strings.TrimSpace(name)] = true
+		}
+	}
+
+	msgs, err := collect(fds, files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *pkg == "" {
+		for _, file := range fds.File {
+			if !skipFile(file.GetName()) && (len(files) == 0 || files[file.GetName()]) {
+				*pkg = goPackage(file)
+				break
+			}
+		}
+	}
+
+	code, err := generate(*in, *pkg, msgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*out, code, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
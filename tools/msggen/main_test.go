@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"gameserver/core/processor/pb"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"strings"
+	"testing"
+)
+
+func testFile(loginId uint32) *descriptorpb.FileDescriptorProto {
+	loginOpts := &descriptorpb.MessageOptions{}
+	proto.SetExtension(loginOpts, pb.E_MsgId, loginId)
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("game/login.proto"),
+		Package: proto.String("game"),
+		Options: &descriptorpb.FileOptions{GoPackage: proto.String("gameserver/game/pb")},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String(msgIdEnum),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("NONE"), Number: proto.Int32(0)},
+				{Name: proto.String("LOGIN_RESP"), Number: proto.Int32(1002)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("LoginReq"), Options: loginOpts},
+			{Name: proto.String("LoginResp")},
+			{Name: proto.String("PlayerInfo")},
+		},
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testFile(1001)}}
+	msgs, err := collect(fds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Const != "LOGIN_REQ_MSG_ID" || msgs[0].Id != 1001 || msgs[1].Id != 1002 {
+		t.Fatalf("msgs %+v %+v", msgs[0], msgs[1])
+	}
+
+	code, err := generate("msg.pb", goPackage(fds.File[0]), msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"package pb", "LOGIN_REQ_MSG_ID: LOGIN_RESP_MSG_ID", "func RegisterLoginRequest(", "func SendLoginResp("} {
+		if !strings.Contains(string(code), want) {
+			t.Fatalf("%q not generated:\n%s", want, code)
+		}
+	}
+}
+
+func TestDuplicateMsgId(t *testing.T) {
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testFile(1002)}}
+	if _, err := collect(fds, nil); err == nil || !strings.Contains(err.Error(), "game.LoginReq and game.LoginResp") {
+		t.Fatalf("err %v", err)
+	}
+}
+
+// type check the generated code against the real processor package, the
+// msgs are stubbed
+func checkCode(t *testing.T, code []byte, stub string) {
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+	for i, src := range []string{string(code), stub} {
+		if src == "" {
+			continue
+		}
+		file, err := parser.ParseFile(fset, fmt.Sprintf("file%v.go", i), src, 0)
+		if err != nil {
+			t.Fatalf("%v:\n%s", err, src)
+		}
+		files = append(files, file)
+	}
+
+	config := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := config.Check("gameserver/game/pb", fset, files, nil); err != nil {
+		t.Fatalf("%v:\n%s", err, code)
+	}
+}
+
+func TestGeneratedCodeBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("type checks dependencies from source")
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testFile(1001)}}
+	msgs, err := collect(fds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := generate("msg.pb", "pb", msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCode(t, code, `package pb
+
+import "google.golang.org/protobuf/types/descriptorpb"
+
+type LoginReq struct{ descriptorpb.FileOptions }
+type LoginResp struct{ descriptorpb.FileOptions }
+`)
+
+	// no msgs, no imports
+	code, err = generate("msg.pb", "pb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCode(t, code, "")
+}